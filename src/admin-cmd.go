@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/plugins/autoprune"
+	"vastai-helper/src/plugins/netattach"
+)
+
+var (
+	statusCmd = kingpin.Command(
+		"status",
+		"Show the state of the running daemon.",
+	)
+	pruneCmd = kingpin.Command(
+		"prune",
+		"Show the last auto-prune run of the running daemon.",
+	)
+	pruneNow = pruneCmd.Flag(
+		"now",
+		"Run auto-prune now and wait for it to finish.",
+	).Bool()
+	leasesCmd = kingpin.Command(
+		"leases",
+		"List the DHCP leases held for attached containers.",
+	)
+	attachmentsCmd = kingpin.Command(
+		"attachments",
+		"List the containers attached to the public network.",
+	)
+	reconcileCmd = kingpin.Command(
+		"reconcile",
+		"Run a container state reconciliation pass now.",
+	)
+)
+
+// runAdminCommand performs the command using the admin socket of the running
+// daemon.
+func runAdminCommand(command string) error {
+	switch command {
+	case statusCmd.FullCommand():
+		return showStatus()
+	case pruneCmd.FullCommand():
+		return showPrune()
+	case leasesCmd.FullCommand():
+		return showLeases()
+	case attachmentsCmd.FullCommand():
+		return showAttachments()
+	case reconcileCmd.FullCommand():
+		if err := adminRequest(http.MethodPost, "/reconcile", nil); err != nil {
+			return err
+		}
+		fmt.Println("Reconciliation complete")
+	}
+	return nil
+}
+
+// adminRequest calls the admin API and decodes the JSON response into result.
+func adminRequest(method string, path string, result interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *adminSocket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://admin"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Cannot connect to the daemon: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/plugins/") {
+		return fmt.Errorf("The %s plugin is not running", strings.Split(path, "/")[2])
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if result == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+func showStatus() error {
+	var status Status
+	if err := adminRequest(http.MethodGet, "/status", &status); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Started:\t%s (up %s)\n", formatTime(status.Started),
+		time.Since(status.Started).Round(time.Second))
+	stream := "disconnected"
+	if status.EventStream {
+		stream = "connected"
+	}
+	fmt.Fprintf(w, "Event stream:\t%s\n", stream)
+	if status.LastEvent != nil {
+		fmt.Fprintf(w, "Last event:\t%s\n", formatTime(*status.LastEvent))
+	} else {
+		fmt.Fprintf(w, "Last event:\t-\n")
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PLUGIN\tCONTAINERS\tRUNNING\tERRORS\tDISABLED UNTIL")
+	for _, p := range status.Plugins {
+		disabledUntil := "-"
+		if p.DisabledUntil != nil {
+			disabledUntil = formatTime(*p.DisabledUntil)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", p.Name, p.Containers, p.Running, p.Errors, disabledUntil)
+	}
+	return w.Flush()
+}
+
+func showPrune() error {
+	var result *autoprune.PruneResult
+	if *pruneNow {
+		fmt.Println("Pruning...")
+		result = &autoprune.PruneResult{}
+		if err := adminRequest(http.MethodPost, "/plugins/autoprune/prune", result); err != nil {
+			return err
+		}
+	} else if err := adminRequest(http.MethodGet, "/plugins/autoprune/prune", &result); err != nil {
+		return err
+	}
+	if result == nil {
+		fmt.Println("No prune run since the daemon was started")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Started:\t%s\n", formatTime(result.Started))
+	fmt.Fprintf(w, "Finished:\t%s\n", formatTime(result.Finished))
+	if result.Pruned {
+		fmt.Fprintf(w, "Reclaimed:\t%s\n", units.BytesSize(float64(result.Reclaimed)))
+	} else {
+		fmt.Fprintf(w, "Reclaimed:\tnothing to prune\n")
+	}
+	if result.Errors > 0 {
+		fmt.Fprintf(w, "Errors:\t%d\n", result.Errors)
+	}
+	fmt.Fprintf(w, "Next run:\t%s\n", formatTime(result.Next))
+	return w.Flush()
+}
+
+func showLeases() error {
+	var leases []netattach.LeaseInfo
+	if err := adminRequest(http.MethodGet, "/plugins/netattach/leases", &leases); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tHOSTNAME\tIP\tGATEWAY\tRENEWED\tTTL")
+	for _, l := range leases {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			shortId(l.ClientId), orDash(l.HostName), l.Ip, orDash(l.Gateway), formatTime(l.Renewed), l.Ttl)
+	}
+	return w.Flush()
+}
+
+func showAttachments() error {
+	var attachments []netattach.AttachmentInfo
+	if err := adminRequest(http.MethodGet, "/plugins/netattach/attachments", &attachments); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tNAME\tIPV6\tIPV4\tPORT RULES")
+	for _, a := range attachments {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n",
+			shortId(a.ContainerId), a.ContainerName, orDash(a.Ipv6), orDash(a.Ipv4), len(a.Rules))
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
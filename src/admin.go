@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/plugins"
+)
+
+var (
+	adminSocket = kingpin.Flag(
+		"admin-socket",
+		"Unix socket of the admin API, used by the status, prune, leases, attachments and reconcile commands.",
+	).Default("/run/vastai-helper.sock").String()
+)
+
+var startTime = time.Now()
+
+// Status is returned by GET /status on the admin socket.
+type Status struct {
+	Started     time.Time      `json:"started"`
+	Plugins     []PluginStatus `json:"plugins"`
+	EventStream bool           `json:"eventStream"` // connected to docker
+	LastEvent   *time.Time     `json:"lastEvent,omitempty"`
+}
+
+type PluginStatus struct {
+	Name          string     `json:"name"`
+	Containers    int        `json:"containers"` // known to the plugin
+	Running       int        `json:"running"`
+	Errors        int        `json:"errors"`
+	DisabledUntil *time.Time `json:"disabledUntil,omitempty"` // after repeated failures
+}
+
+// startAdminServer serves the admin API on a unix socket which is only
+// accessible by root. Requests are cancelled when the context is.
+func startAdminServer(ctx context.Context) *http.Server {
+	logger := log.WithFields(log.Fields{"socket": *adminSocket})
+	os.Remove(*adminSocket) // left over from an unclean shutdown
+	listener, err := net.Listen("unix", *adminSocket)
+	if err != nil {
+		logger.Error("Cannot create admin socket: ", err)
+		return nil
+	}
+	if err := os.Chmod(*adminSocket, 0600); err != nil {
+		logger.Error(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/reconcile", serveReconcile)
+	for _, p := range activePlugins {
+		if a, ok := p.(plugins.AdminPlugin); ok {
+			for path, handler := range a.AdminHandlers() {
+				mux.HandleFunc("/plugins/"+pluginName(p)+"/"+path, handler)
+			}
+		}
+	}
+	server := &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		logger.Info("Starting admin server")
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logger.Error(err)
+		}
+	}()
+	return server
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	status := Status{Started: startTime, Plugins: []PluginStatus{}}
+	status.EventStream, status.LastEvent = eventStreamStatus()
+	for _, p := range activePlugins {
+		ps := PluginStatus{Name: pluginName(p)}
+		errors, disabledUntil := dispatcher.breakers[p].state()
+		ps.Errors = errors
+		if !disabledUntil.IsZero() {
+			ps.DisabledUntil = &disabledUntil
+		}
+		for _, state := range getPluginStates(p) {
+			ps.Containers++
+			if state.running {
+				ps.Running++
+			}
+		}
+		status.Plugins = append(status.Plugins, ps)
+	}
+	sort.Slice(status.Plugins, func(i, j int) bool {
+		return status.Plugins[i].Name < status.Plugins[j].Name
+	})
+	plugins.WriteJson(w, &status)
+}
+
+// serveReconcile runs a reconciliation pass in the event loop and returns
+// when it is finished.
+func serveReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	done := make(chan error, 1)
+	select {
+	case reconcileRequests <- done:
+	case <-r.Context().Done():
+		http.Error(w, r.Context().Err().Error(), http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+		http.Error(w, r.Context().Err().Error(), http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/metrics"
+)
+
+var (
+	pluginMaxFailures = kingpin.Flag(
+		"plugin-max-failures",
+		"Consecutive failed calls after which a plugin is disabled for --plugin-disable-time (0 never disables).",
+	).Default("5").Int()
+	pluginDisableTime = kingpin.Flag(
+		"plugin-disable-time",
+		"Time a failing plugin is disabled for, it is enabled again on probation afterwards.",
+	).Default("5m").Duration()
+
+	pluginDisabled = metrics.NewGaugeVec(
+		"plugin_disabled",
+		"1 while a plugin is disabled because it kept failing.",
+		"plugin",
+	)
+	pluginSkipped = metrics.NewCounterVec(
+		"plugin_calls_skipped_total",
+		"Plugin calls not made because the plugin was disabled.",
+		"plugin",
+	)
+)
+
+// breaker disables a plugin which keeps failing, so that its queue does not
+// fill up with calls which fail anyway. Calls skipped meanwhile are caught up
+// by reconciliation once the plugin is enabled again.
+type breaker struct {
+	name          string
+	mu            sync.Mutex
+	failures      int // consecutive
+	errors        int // total
+	disabledUntil time.Time
+}
+
+// allow returns false while the plugin is disabled.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.disabledUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.disabledUntil) {
+		pluginSkipped.With(b.name).Inc()
+		return false
+	}
+	// on probation: a single failure disables the plugin again
+	log.WithFields(log.Fields{"plugin": b.name}).Info("Enabling plugin again")
+	b.disabledUntil = time.Time{}
+	b.failures = getSettings().pluginMaxFailures - 1
+	pluginDisabled.With(b.name).Set(0)
+	return true
+}
+
+// record counts the outcome of a call.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.errors++
+	b.failures++
+	settings := getSettings()
+	if settings.pluginMaxFailures > 0 && b.failures >= settings.pluginMaxFailures && b.disabledUntil.IsZero() {
+		b.disabledUntil = time.Now().Add(settings.pluginDisableTime)
+		pluginDisabled.With(b.name).Set(1)
+		log.WithFields(log.Fields{
+			"plugin":   b.name,
+			"failures": b.failures,
+			"until":    b.disabledUntil.Format(time.RFC3339),
+		}).Error("Plugin keeps failing, disabling it temporarily")
+	}
+}
+
+// state returns the total number of errors and the time until which the
+// plugin is disabled, zero if it is enabled.
+func (b *breaker) state() (int, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().After(b.disabledUntil) {
+		return b.errors, time.Time{}
+	}
+	return b.errors, b.disabledUntil
+}
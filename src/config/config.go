@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Config applies settings from a YAML file on top of the command line flags.
+// Keys are flag names without the leading dashes, e.g.
+//
+//	expire-time: 48h
+//	web-server-bind: 127.0.0.1:9014
+//
+// Values from the file take precedence over the command line. When a key is
+// removed from the file, the flag reverts to its command line value on the
+// next Load.
+type Config struct {
+	Path  string
+	flags map[string]*kingpin.FlagModel
+	orig  map[string][]string // command line values of flags set from the file
+}
+
+// listValue is implemented by repeatable flag values which can be set from
+// the configuration file, see StringList.
+type listValue interface {
+	kingpin.Value
+	Reset()
+	Values() []string
+}
+
+// notConfigurable are flags which only make sense on the command line.
+var notConfigurable = map[string]bool{
+	"help":                   true,
+	"help-long":              true,
+	"help-man":               true,
+	"completion-bash":        true,
+	"completion-script-bash": true,
+	"completion-script-zsh":  true,
+	"config":                 true,
+}
+
+func New(app *kingpin.Application, path string) *Config {
+	c := &Config{
+		Path:  path,
+		flags: make(map[string]*kingpin.FlagModel),
+		orig:  make(map[string][]string),
+	}
+	for _, flag := range app.Model().Flags {
+		if !notConfigurable[flag.Name] {
+			c.flags[flag.Name] = flag
+		}
+	}
+	return c
+}
+
+// Load reads the file and applies it to the flags. A missing file is only
+// an error if required is set. The file is fully validated before any flag
+// is changed, although a value can still be rejected by the flag itself.
+func (c *Config) Load(required bool) error {
+	settings, err := c.read(required)
+	if err != nil {
+		return err
+	}
+
+	// revert flags which are no longer set in the file
+	for name, values := range c.orig {
+		if _, ok := settings[name]; !ok {
+			if err := c.set(name, values); err != nil {
+				return err
+			}
+			delete(c.orig, name)
+		}
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := c.orig[name]; !ok {
+			c.orig[name] = c.get(name)
+		}
+		if err := c.set(name, settings[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) read(required bool) (map[string][]string, error) {
+	result := make(map[string][]string)
+	data, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) && !required {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	raw := make(map[string]interface{})
+	if err := yaml.UnmarshalStrict(data, &raw); err != nil {
+		return result, fmt.Errorf("%s: %v", c.Path, err)
+	}
+	for name, value := range raw {
+		flag, ok := c.flags[name]
+		if !ok {
+			return result, fmt.Errorf("%s: unknown setting %q", c.Path, name)
+		}
+		_, isList := flag.Value.(listValue)
+		switch v := value.(type) {
+		case []interface{}:
+			if !isList {
+				return result, fmt.Errorf("%s: %q does not accept a list", c.Path, name)
+			}
+			for _, item := range v {
+				result[name] = append(result[name], fmt.Sprint(item))
+			}
+		case map[interface{}]interface{}:
+			return result, fmt.Errorf("%s: invalid value for %q", c.Path, name)
+		case nil:
+			result[name] = []string{}
+		default:
+			result[name] = []string{fmt.Sprint(v)}
+		}
+		if !isList && len(result[name]) != 1 {
+			return result, fmt.Errorf("%s: missing value for %q", c.Path, name)
+		}
+		if cumulative, ok := flag.Value.(interface{ IsCumulative() bool }); ok && cumulative.IsCumulative() && !isList {
+			return result, fmt.Errorf("%s: %q can only be set on the command line", c.Path, name)
+		}
+	}
+	return result, nil
+}
+
+func (c *Config) get(name string) []string {
+	value := c.flags[name].Value
+	if list, ok := value.(listValue); ok {
+		return list.Values()
+	}
+	return []string{value.String()}
+}
+
+func (c *Config) set(name string, values []string) error {
+	value := c.flags[name].Value
+	if list, ok := value.(listValue); ok {
+		list.Reset()
+	}
+	for _, v := range values {
+		if err := value.Set(v); err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %v", c.Path, name, err)
+		}
+	}
+	return nil
+}
+
+// StringList turns the flag into a repeatable string flag, which can also be
+// set from the configuration file as a list.
+func StringList(flag *kingpin.FlagClause) *[]string {
+	target := &[]string{}
+	flag.SetValue((*stringList)(target))
+	return target
+}
+
+type stringList []string
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) IsCumulative() bool {
+	return true
+}
+
+func (l *stringList) Reset() {
+	*l = nil
+}
+
+func (l *stringList) Values() []string {
+	return append([]string{}, *l...)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/metrics"
+	"vastai-helper/src/plugins"
+)
+
+var (
+	dispatchWorkers = kingpin.Flag(
+		"dispatch-workers",
+		"Number of concurrent workers per plugin.",
+	).Default("4").Int()
+	dispatchQueueSize = kingpin.Flag(
+		"dispatch-queue-size",
+		"Maximum number of queued events per worker.",
+	).Default("256").Int()
+	pluginTimeout = kingpin.Flag(
+		"plugin-timeout",
+		"Deadline for a single plugin call.",
+	).Default("2m").Duration()
+
+	pluginErrors = metrics.NewCounterVec(
+		"plugin_errors_total",
+		"Plugin calls which returned an error or panicked.",
+		"plugin",
+	)
+	pluginPanics = metrics.NewCounterVec(
+		"plugin_panics_total",
+		"Plugin calls which panicked.",
+		"plugin",
+	)
+)
+
+// Dispatcher delivers calls to plugins. Each plugin has its own pool of
+// workers, and calls are assigned to a worker by key (container or image id),
+// so calls for the same container are processed strictly in order, while
+// different containers and different plugins are processed concurrently.
+type Dispatcher struct {
+	ctx      context.Context
+	timeout  time.Duration
+	queues   map[plugins.Plugin][]chan func()
+	breakers map[plugins.Plugin]*breaker
+	pending  sync.WaitGroup
+}
+
+func newDispatcher(ctx context.Context, list []plugins.Plugin, workers int, queueSize int, timeout time.Duration) *Dispatcher {
+	d := &Dispatcher{
+		ctx:      ctx,
+		timeout:  timeout,
+		queues:   make(map[plugins.Plugin][]chan func()),
+		breakers: make(map[plugins.Plugin]*breaker),
+	}
+	for _, p := range list {
+		queues := make([]chan func(), workers)
+		for i := range queues {
+			queues[i] = make(chan func(), queueSize)
+			go d.worker(queues[i])
+		}
+		d.queues[p] = queues
+		d.breakers[p] = &breaker{name: pluginName(p)}
+	}
+	return d
+}
+
+func (d *Dispatcher) worker(queue chan func()) {
+	for task := range queue {
+		task()
+		d.pending.Done()
+	}
+}
+
+// dispatch queues f for every plugin. f returns the error of the plugin call,
+// after logging it.
+func (d *Dispatcher) dispatch(key string, f func(ctx context.Context, p plugins.Plugin) error) {
+	for _, p := range activePlugins {
+		d.dispatchTo(p, key, f)
+	}
+}
+
+// dispatchTo queues f for a single plugin. It blocks when the queue is full.
+// f is called with a context which expires after the plugin timeout. Nothing
+// is queued while the plugin is disabled by its breaker.
+func (d *Dispatcher) dispatchTo(p plugins.Plugin, key string, f func(ctx context.Context, p plugins.Plugin) error) {
+	b := d.breakers[p]
+	if !b.allow() {
+		return
+	}
+	queues := d.queues[p]
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	queue := queues[h.Sum32()%uint32(len(queues))]
+
+	if depth := len(queue); depth >= cap(queue)/2 {
+		log.WithFields(log.Fields{
+			"plugin": pluginName(p),
+			"depth":  depth,
+		}).Warn("Plugin queue is backing up")
+	}
+
+	d.pending.Add(1)
+	queue <- func() {
+		ctx, cancel := context.WithTimeout(d.ctx, d.timeout)
+		defer cancel()
+		b.record(protect(p, func() error { return f(ctx, p) }))
+	}
+}
+
+// wait blocks until all queued calls are processed.
+func (d *Dispatcher) wait() {
+	d.pending.Wait()
+}
+
+// shutdown waits for the queued calls like wait, but gives up when ctx
+// expires. Nothing must be dispatched afterwards.
+func (d *Dispatcher) shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		for _, queues := range d.queues {
+			for _, queue := range queues {
+				close(queue)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// protect calls f, turning a panic into an error, so that a failing plugin
+// does not take down the daemon and the other plugins.
+func protect(p plugins.Plugin, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			pluginPanics.With(pluginName(p)).Inc()
+			pluginErrors.With(pluginName(p)).Inc()
+			log.WithFields(log.Fields{"plugin": pluginName(p)}).
+				Errorf("Plugin panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return f()
+}
+
+// backgroundPanicked counts a panic of a plugin's background loop like one
+// of a plugin call, towards disabling the plugin as well.
+func backgroundPanicked(name string, r interface{}, stack []byte) {
+	pluginPanics.With(name).Inc()
+	pluginErrors.With(name).Inc()
+	log.WithFields(log.Fields{"plugin": name}).
+		Errorf("Plugin background loop panicked: %v\n%s", r, stack)
+	for _, p := range activePlugins {
+		if pluginName(p) == name {
+			dispatcher.breakers[p].record(fmt.Errorf("panic: %v", r))
+		}
+	}
+}
+
+// pluginFailed logs and counts an error returned by a plugin call.
+func pluginFailed(p plugins.Plugin, err error, logger *log.Entry) {
+	pluginErrors.With(pluginName(p)).Inc()
+	logger.WithFields(log.Fields{"plugin": pluginName(p)}).Error(err)
+}
+
+func pluginName(p plugins.Plugin) string {
+	return pluginNames[p]
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -11,106 +14,317 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/metrics"
+	"vastai-helper/src/plugins"
+	"vastai-helper/src/rules"
+)
+
+var (
+	watchFilter = rules.NewFilter(
+		kingpin.Flag(
+			"watch-include",
+			"Only pass events of containers matching the rule to plugins (repeatable).",
+		),
+		kingpin.Flag(
+			"watch-exclude",
+			"Do not pass events of containers matching the rule to plugins (repeatable). Temporary build containers are always excluded.",
+		),
+	).AlwaysExclude("image=sha256:*")
+
+	dockerEvents = metrics.NewCounterVec(
+		"docker_events_total",
+		"Docker events received, by type and action.",
+		"type", "action",
+	)
 )
 
-func dockerEventLoop(ctx context.Context, cli *client.Client) {
+// streamStatus is reported on the admin socket and by health checks.
+var streamStatus = struct {
+	sync.Mutex
+	connected bool
+	since     time.Time // of the last connect or disconnect
+	lastEvent time.Time
+}{since: time.Now()}
+
+// eventStreamStatus returns whether the event stream is connected and the
+// time of the last processed event, nil if there was none yet.
+func eventStreamStatus() (bool, *time.Time) {
+	streamStatus.Lock()
+	defer streamStatus.Unlock()
+	if streamStatus.lastEvent.IsZero() {
+		return streamStatus.connected, nil
+	}
+	last := streamStatus.lastEvent
+	return streamStatus.connected, &last
+}
+
+func setStreamConnected(connected bool) {
+	streamStatus.Lock()
+	streamStatus.connected = connected
+	streamStatus.since = time.Now()
+	streamStatus.Unlock()
+}
+
+func dockerEventLoop(ctx context.Context, cli dockerapi.Client) {
 	retry := 5 * time.Second
+	stream := eventStream{lastTs: time.Now().UnixNano()}
+	reconnect := false
+
+	for ctx.Err() == nil {
+		if reconnect {
+			// replay events missed while disconnected
+			until := time.Now()
+			log.WithFields(log.Fields{"since": stream.lastTime().Format(time.RFC3339Nano)}).
+				Info("Replaying missed docker events")
+			setStatus("Replaying missed docker events")
+			err := stream.read(ctx, cli, formatEventTime(until))
+			if ctx.Err() != nil {
+				break
+			}
+			if err != io.EOF {
+				log.WithFields(log.Fields{"retry": retry}).Error("Error replaying docker events: ", err)
+				setStatus("Error replaying docker events: " + err.Error())
+				idle(ctx, retry)
+				continue
+			}
+			// catch up with whatever the replay could not tell
+			if err := reconcileContainers(ctx, cli); err != nil {
+				log.Error(err)
+			}
+		}
 
-	for {
 		log.Info("Waiting for docker events")
+		setStatus("Watching docker events")
+		err := stream.read(ctx, cli, "")
+		if ctx.Err() != nil {
+			break
+		}
+		log.WithFields(log.Fields{"retry": retry}).Error("Error reading docker events: ", err)
+		setStatus("Error reading docker events: " + err.Error())
+		idle(ctx, retry)
+		reconnect = true
+	}
+	log.Info("Stopped reading docker events")
+}
 
-		ctx, cancel := context.WithCancel(ctx)
-		eventChan, errChan := cli.Events(ctx, types.EventsOptions{
-			Filters: filters.NewArgs(
-				filters.Arg("Type", "container"),
-				filters.Arg("Type", "image"),
-			),
-		})
+// eventStream remembers the last processed event, so that the subscription
+// can be resumed with --since after a reconnect. Docker resolution for the
+// since filter is one nanosecond, but several events may share the same
+// timestamp, so the ones already seen at lastTs are kept for deduplication.
+type eventStream struct {
+	lastTs   int64
+	lastSeen map[string]bool
+}
+
+// read subscribes to docker events (resuming after the last processed one)
+// and processes them until an error occurs. With until set, the stream ends
+// with io.EOF once all events up to that time are received.
+func (s *eventStream) read(ctx context.Context, cli dockerapi.Client, until string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	eventChan, errChan := cli.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("Type", "container"),
+			filters.Arg("Type", "image"),
+			filters.Arg("Type", "network"),
+		),
+		Since: formatEventTime(s.lastTime()),
+		Until: until,
+	})
+	setStreamConnected(true)
+	defer setStreamConnected(false)
+
+	ticker := time.NewTicker(*reconcileInterval)
+	defer ticker.Stop()
 
-		quit := false
-		for !quit {
-			select {
-			case event := <-eventChan:
+	for {
+		select {
+		case event := <-eventChan:
+			if s.accept(&event) {
+				streamStatus.Lock()
+				streamStatus.lastEvent = time.Unix(0, event.TimeNano)
+				streamStatus.Unlock()
+				dockerEvents.With(event.Type, eventAction(event.Action)).Inc()
+				journalEvent(&event)
 				processEvent(ctx, cli, &event)
-			case err := <-errChan:
-				log.WithFields(log.Fields{"retry": retry}).Error("Error reading docker events: ", err)
-				quit = true
 			}
+		case <-ticker.C:
+			if err := reconcileContainers(ctx, cli); err != nil {
+				log.Error(err)
+			}
+		case <-reloadRequests:
+			reloadConfig()
+			ticker.Reset(*reconcileInterval)
+		case <-watchdogProbes:
+		case done := <-reconcileRequests:
+			done <- reconcileContainers(ctx, cli)
+			ticker.Reset(*reconcileInterval)
+		case err := <-errChan:
+			return err
 		}
+	}
+}
 
-		cancel()
-		time.Sleep(5 * time.Second)
+// accept returns false for events which were already processed.
+func (s *eventStream) accept(event *events.Message) bool {
+	if event.TimeNano < s.lastTs {
+		return false
+	}
+	key := event.Type + " " + event.Action + " " + event.Actor.ID + " " + event.Actor.Attributes["container"]
+	if event.TimeNano == s.lastTs {
+		if s.lastSeen[key] {
+			return false
+		}
+	}
+	if event.TimeNano != s.lastTs || s.lastSeen == nil {
+		s.lastTs = event.TimeNano
+		s.lastSeen = make(map[string]bool)
+	}
+	s.lastSeen[key] = true
+	return true
+}
 
-		// TODO redo container discover because events could have been missed
-		// TODO or better use the --since filter?
+func (s *eventStream) lastTime() time.Time {
+	return time.Unix(0, s.lastTs)
+}
+
+// eventAction strips the details docker appends to some actions, e.g.
+// "exec_start: bash".
+func eventAction(action string) string {
+	if i := strings.Index(action, ": "); i >= 0 {
+		return action[:i]
 	}
+	return action
+}
+
+func formatEventTime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
 }
 
-func processEvent(ctx context.Context, cli *client.Client, event *events.Message) {
+func processEvent(ctx context.Context, cli dockerapi.Client, event *events.Message) {
 	if event.Type == "container" {
-		cid := event.Actor.ID
-		if cid == "" {
+		if event.Actor.ID == "" {
 			return
 		}
-		cname := event.Actor.Attributes["name"]
-		image := event.Actor.Attributes["image"]
-		if !shouldWatchContainer(cname, image) {
+		ev := newContainerEvent(event)
+		if !shouldWatchContainer(ev.ContainerName, ev.Image, ev.Labels) {
 			return
 		}
 		logger := log.WithFields(log.Fields{
 			"event": event.Action,
-			"cid":   cid[0:12],
-			"cname": cname,
-			"image": image,
+			"cid":   shortId(ev.ContainerId),
+			"cname": ev.ContainerName,
+			"image": ev.Image,
 		})
 
 		if event.Action == "create" {
 			logger.Info("Container created")
 			// plugin call
-			callPlugin(func(p Plugin) error {
-				return p.ContainerCreated(cid, cname, image)
-			}, logger)
+			callContainerPlugin(ev, &containerState{ev.ContainerName, ev.Image, ev.Labels, false},
+				plugins.Plugin.ContainerCreated, logger)
 
 		} else if event.Action == "start" {
 			logger.Info("Container started")
 			// plugin call
-			callPlugin(func(p Plugin) error {
-				return p.ContainerStarted(cid, cname, image)
-			}, logger)
+			callContainerPlugin(ev, &containerState{ev.ContainerName, ev.Image, ev.Labels, true},
+				plugins.Plugin.ContainerStarted, logger)
 
 		} else if event.Action == "die" {
-			exitCode, _ := strconv.Atoi(event.Actor.Attributes["exitCode"])
-			if exitCode == 0 {
+			if ev.ExitCode == 0 {
 				logger.Info("Container exited normally")
-			} else if exitCode > 128 {
+			} else if ev.Signal != 0 {
 				logger.
-					WithFields(log.Fields{"signal": exitCode - 128}).
+					WithFields(log.Fields{"signal": ev.Signal}).
 					Warn("Container killed with signal")
 			} else {
 				logger.
-					WithFields(log.Fields{"exitCode": exitCode}).
+					WithFields(log.Fields{"exitCode": ev.ExitCode}).
 					Warn("Container exited with error")
 			}
 			// plugin call
-			callPlugin(func(p Plugin) error {
-				return p.ContainerStopped(cid, cname, image)
-			}, logger)
+			callContainerPlugin(ev, &containerState{ev.ContainerName, ev.Image, ev.Labels, false},
+				plugins.Plugin.ContainerStopped, logger)
 
 		} else if event.Action == "destroy" {
 			logger.Info("Container destroyed")
 			// plugin call
-			callPlugin(func(p Plugin) error {
-				return p.ContainerDestroyed(cid, cname, image)
-			}, logger)
+			callContainerPlugin(ev, nil, plugins.Plugin.ContainerDestroyed, logger)
 
-		} else if strings.HasPrefix(event.Action, "exec_start: ") {
+		} else if ev.Action == "exec_start" {
 			logger.
-				WithFields(log.Fields{"event": "exec", "cmd": strings.TrimSpace(event.Action[12:])}).
+				WithFields(log.Fields{"event": "exec", "cmd": ev.ExecCommand}).
 				Info("Container exec")
+			// plugin call
+			callPlugin(ev.ContainerId, ev, plugins.Plugin.ContainerExec, logger)
 
 		} else if event.Action == "oom" {
 			logger.Warn("Container triggered OOM")
+			// plugin call
+			callPlugin(ev.ContainerId, ev, plugins.Plugin.ContainerOOM, logger)
+
+		} else if event.Action == "pause" {
+			logger.Info("Container paused")
+			// plugin call
+			callPlugin(ev.ContainerId, ev, plugins.Plugin.ContainerPaused, logger)
+
+		} else if event.Action == "unpause" {
+			logger.Info("Container unpaused")
+			// plugin call
+			callPlugin(ev.ContainerId, ev, plugins.Plugin.ContainerUnpaused, logger)
+
+		} else if ev.Action == "health_status" {
+			logger = logger.WithFields(log.Fields{"event": ev.Action, "health": ev.HealthStatus})
+			if ev.HealthStatus == "unhealthy" {
+				logger.Warn("Container health status changed")
+			} else {
+				logger.Info("Container health status changed")
+			}
+			// plugin call
+			callPlugin(ev.ContainerId, ev, plugins.Plugin.ContainerHealthStatus, logger)
+
+		} else if event.Action == "rename" {
+			logger.WithFields(log.Fields{"oldname": ev.OldName}).Info("Container renamed")
+			renameContainerState(ev.ContainerId, ev.ContainerName)
+			// plugin call
+			callPlugin(ev.ContainerId, ev, plugins.Plugin.ContainerRenamed, logger)
+		}
+	}
+
+	if event.Type == "network" {
+		cid := event.Actor.Attributes["container"]
+		if cid == "" {
+			return
+		}
+		state, ok := findContainerState(cid)
+		if !ok || !shouldWatchContainer(state.cname, state.image, state.labels) {
+			return
+		}
+		ev := newSyntheticEvent(event.Action, cid, &state)
+		ev.Time = time.Unix(0, event.TimeNano)
+		ev.Synthetic = false
+		ev.Attributes = event.Actor.Attributes
+		ev.NetworkId = event.Actor.ID
+		ev.NetworkName = event.Actor.Attributes["name"]
+		logger := log.WithFields(log.Fields{
+			"event": event.Action,
+			"cid":   shortId(cid),
+			"cname": state.cname,
+			"net":   ev.NetworkName,
+		})
+
+		if event.Action == "connect" {
+			logger.Info("Container connected to network")
+			// plugin call
+			callPlugin(cid, ev, plugins.Plugin.NetworkConnected, logger)
+
+		} else if event.Action == "disconnect" {
+			logger.Info("Container disconnected from network")
+			// plugin call
+			callPlugin(cid, ev, plugins.Plugin.NetworkDisconnected, logger)
 		}
 	}
 
@@ -125,14 +339,79 @@ func processEvent(ctx context.Context, cli *client.Client, event *events.Message
 
 		} else if event.Action == "delete" {
 			// plugin call
-			callPlugin(func(p Plugin) error {
-				return p.ImageRemoved(event.Actor.ID)
-			}, logger)
+			ev := &plugins.Event{
+				Version:    plugins.EventVersion,
+				Action:     event.Action,
+				Time:       time.Unix(0, event.TimeNano),
+				Image:      event.Actor.ID,
+				Attributes: event.Actor.Attributes,
+			}
+			callPlugin(event.Actor.ID, ev, plugins.Plugin.ImageRemoved, logger)
+		}
+	}
+}
+
+// nonLabelAttributes are container event attributes which are added by
+// docker, the remaining ones are container labels.
+var nonLabelAttributes = map[string]bool{
+	"name":     true,
+	"image":    true,
+	"exitCode": true,
+	"signal":   true,
+	"oldName":  true,
+}
+
+func newContainerEvent(event *events.Message) *plugins.Event {
+	attrs := event.Actor.Attributes
+	result := &plugins.Event{
+		Version:       plugins.EventVersion,
+		Action:        event.Action,
+		Time:          time.Unix(0, event.TimeNano),
+		ContainerId:   event.Actor.ID,
+		ContainerName: attrs["name"],
+		Image:         attrs["image"],
+		Labels:        make(map[string]string),
+		Attributes:    attrs,
+	}
+	for k, v := range attrs {
+		if !nonLabelAttributes[k] {
+			result.Labels[k] = v
+		}
+	}
+	if event.Action == "die" {
+		result.ExitCode, _ = strconv.Atoi(attrs["exitCode"])
+		if result.ExitCode > 128 {
+			result.Signal = result.ExitCode - 128
 		}
+	} else if event.Action == "rename" {
+		result.OldName = strings.TrimPrefix(attrs["oldName"], "/")
+	} else if strings.HasPrefix(event.Action, "health_status: ") {
+		result.Action = "health_status"
+		result.HealthStatus = strings.TrimSpace(event.Action[15:])
+	} else if strings.HasPrefix(event.Action, "exec_start: ") {
+		result.Action = "exec_start"
+		result.ExecCommand = strings.TrimSpace(event.Action[12:])
+	}
+	return result
+}
+
+// newSyntheticEvent creates an event for a container state change which was
+// not received from docker.
+func newSyntheticEvent(action string, cid string, state *containerState) *plugins.Event {
+	return &plugins.Event{
+		Version:       plugins.EventVersion,
+		Action:        action,
+		Time:          time.Now(),
+		Synthetic:     true,
+		ContainerId:   cid,
+		ContainerName: state.cname,
+		Image:         state.image,
+		Labels:        state.labels,
+		Attributes:    map[string]string{},
 	}
 }
 
-func discoverContainers(ctx context.Context, cli *client.Client) error {
+func discoverContainers(ctx context.Context, cli dockerapi.Client) error {
 	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
 		All: true,
 	})
@@ -143,32 +422,66 @@ func discoverContainers(ctx context.Context, cli *client.Client) error {
 		cid := container.ID
 		cname := strings.TrimLeft(container.Names[0], "/")
 		image := container.Image
-		if shouldWatchContainer(cname, image) {
+		if shouldWatchContainer(cname, image, container.Labels) {
 			logger := log.WithFields(log.Fields{
-				"cid":   cid[0:12],
+				"cid":   shortId(cid),
 				"cname": cname,
 				"image": image,
 			})
 			logger.Info("Container discovered")
-			callPlugin(func(p Plugin) error {
-				return p.ContainerDiscovered(cid, cname, image)
-			}, logger)
+			state := containerState{cname, image, container.Labels, isRunning(container.State)}
+			discoverContainer(newSyntheticEvent("discover", cid, &state), &state, logger)
 		}
 	}
 	return nil
 
 }
 
-func callPlugin(f func(p Plugin) error, logger *log.Entry) {
-	for _, p := range plugins {
-		err := f(p)
+// discoverContainer is like callContainerPlugin, but records no state for
+// stateful plugins. What they know is loaded from KnownContainers instead, so
+// that reconciliation replays the containers created or started while
+// vastai-helper was down.
+func discoverContainer(event *plugins.Event, state *containerState, logger *log.Entry) {
+	cid := event.ContainerId
+	dispatcher.dispatch(cid, func(ctx context.Context, p plugins.Plugin) error {
+		if err := p.ContainerDiscovered(ctx, event); err != nil {
+			pluginFailed(p, err, logger)
+			return err
+		}
+		if _, ok := p.(plugins.StatefulPlugin); !ok {
+			setPluginState(p, cid, state)
+		}
+		return nil
+	})
+}
+
+// hook is a method expression of plugins.Plugin, e.g. plugins.Plugin.ContainerCreated.
+type hook func(p plugins.Plugin, ctx context.Context, event *plugins.Event) error
+
+func callPlugin(key string, event *plugins.Event, f hook, logger *log.Entry) {
+	dispatcher.dispatch(key, func(ctx context.Context, p plugins.Plugin) error {
+		err := f(p, ctx, event)
 		if err != nil {
-			logger.Error(err)
+			pluginFailed(p, err, logger)
 		}
-	}
+		return err
+	})
+}
+
+// callContainerPlugin is like callPlugin, but also records the new container
+// state for each plugin which handled the call successfully.
+func callContainerPlugin(event *plugins.Event, state *containerState, f hook, logger *log.Entry) {
+	cid := event.ContainerId
+	dispatcher.dispatch(cid, func(ctx context.Context, p plugins.Plugin) error {
+		if err := f(p, ctx, event); err != nil {
+			pluginFailed(p, err, logger)
+			return err
+		}
+		setPluginState(p, cid, state)
+		return nil
+	})
 }
 
-func shouldWatchContainer(cname string, image string) bool {
-	// ignore temporary containers
-	return !strings.HasPrefix(image, "sha256:")
+func shouldWatchContainer(cname string, image string, labels map[string]string) bool {
+	return watchFilter.Match(rules.Container{Name: cname, Image: image, Labels: labels})
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+
+	"vastai-helper/src/dockerapi"
+)
+
+// replay reads the events the fake daemon has recorded since the last
+// accepted one, like read does after a reconnect, and returns the accepted.
+func replay(t *testing.T, cli *dockerapi.Fake, s *eventStream) []events.Message {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eventChan, errChan := cli.Events(ctx, types.EventsOptions{
+		Since: formatEventTime(s.lastTime()),
+		Until: formatEventTime(time.Now()),
+	})
+	accepted := []events.Message{}
+	for {
+		select {
+		case event := <-eventChan:
+			if s.accept(&event) {
+				accepted = append(accepted, event)
+			}
+		case err := <-errChan:
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			return accepted
+		}
+	}
+}
+
+func emitAt(cli *dockerapi.Fake, ts int64, action string, id string) {
+	cli.Emit(events.Message{
+		Type:     events.ContainerEventType,
+		Action:   action,
+		Actor:    events.Actor{ID: id},
+		TimeNano: ts,
+	})
+}
+
+func TestEventStreamReplay(t *testing.T) {
+	cli := dockerapi.NewFake()
+	base := time.Now().Add(-time.Minute).UnixNano()
+	s := &eventStream{lastTs: base}
+
+	emitAt(cli, base-1, "create", "old") // before the stream started
+	emitAt(cli, base+1, "create", "a")
+	emitAt(cli, base+2, "start", "a")
+	emitAt(cli, base+2, "start", "b") // same timestamp
+	if got := replay(t, cli, s); len(got) != 3 {
+		t.Fatalf("accepted %d events, want 3: %v", len(got), got)
+	}
+	if s.lastTs != base+2 {
+		t.Errorf("lastTs %d, want %d", s.lastTs, base+2)
+	}
+
+	// resuming with --since the last timestamp gets both events at it again
+	emitAt(cli, base+2, "start", "c")
+	emitAt(cli, base+3, "die", "a")
+	got := replay(t, cli, s)
+	if len(got) != 2 || got[0].Actor.ID != "c" || got[1].Actor.ID != "a" {
+		t.Fatalf("accepted %v, want start c and die a", got)
+	}
+
+	if got := replay(t, cli, s); len(got) != 0 {
+		t.Errorf("accepted %v after replaying everything", got)
+	}
+}
+
+func TestEventStreamDedupe(t *testing.T) {
+	s := &eventStream{lastTs: 100}
+	network := func(action string, container string) *events.Message {
+		return &events.Message{
+			Type:     events.NetworkEventType,
+			Action:   action,
+			Actor:    events.Actor{ID: "net", Attributes: map[string]string{"container": container}},
+			TimeNano: 100,
+		}
+	}
+	if !s.accept(network("connect", "a")) || !s.accept(network("connect", "b")) {
+		t.Error("network events for different containers must both be accepted")
+	}
+	if s.accept(network("connect", "a")) {
+		t.Error("duplicate network event was accepted")
+	}
+	if !s.accept(network("disconnect", "a")) {
+		t.Error("different action was rejected")
+	}
+	if s.accept(&events.Message{Type: events.ContainerEventType, Action: "start", TimeNano: 99}) {
+		t.Error("event older than the last one was accepted")
+	}
+}
@@ -0,0 +1,718 @@
+package dockerapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// Fake is an in-memory Docker daemon. Containers, images, networks and build
+// cache are added by the test, lifecycle helpers and network calls emit the
+// same events dockerd would, and every emitted event is kept so that Events
+// can replay them with Since/Until.
+type Fake struct {
+	mu          sync.Mutex
+	containers  map[string]*types.ContainerJSON
+	images      map[string]*FakeImage
+	networks    map[string]*types.NetworkResource
+	buildCache  []*types.BuildCache
+	events      []events.Message
+	subscribers map[*subscriber]bool
+	nextId      int
+}
+
+// FakeImage is an image known to the fake daemon.
+type FakeImage struct {
+	Summary types.ImageSummary
+	History []image.HistoryResponseItem
+}
+
+var _ Client = (*Fake)(nil)
+
+func NewFake() *Fake {
+	return &Fake{
+		containers:  make(map[string]*types.ContainerJSON),
+		images:      make(map[string]*FakeImage),
+		networks:    make(map[string]*types.NetworkResource),
+		subscribers: make(map[*subscriber]bool),
+	}
+}
+
+// FakeContainer returns a created (not running) container with all the
+// sections vastai-helper looks at filled in.
+func FakeContainer(id string, name string, imageName string, labels map[string]string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + name,
+			Created:    time.Now().UTC().Format(time.RFC3339Nano),
+			Image:      imageName,
+			State:      &types.ContainerState{Status: "created"},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{
+			Image:  imageName,
+			Labels: labels,
+		},
+		NetworkSettings: &types.NetworkSettings{
+			Networks: make(map[string]*network.EndpointSettings),
+		},
+	}
+}
+
+func (f *Fake) newId() string {
+	f.nextId++
+	return fmt.Sprintf("%064x", f.nextId)
+}
+
+// AddContainer stores the container without emitting any event, as if it
+// existed before the daemon was started.
+func (f *Fake) AddContainer(ct types.ContainerJSON) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers[ct.ID] = &ct
+}
+
+// AddImage stores the image without emitting any event.
+func (f *Fake) AddImage(img FakeImage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[img.Summary.ID] = &img
+}
+
+// AddNetwork stores the network without emitting any event.
+func (f *Fake) AddNetwork(net types.NetworkResource) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if net.Containers == nil {
+		net.Containers = make(map[string]types.EndpointResource)
+	}
+	f.networks[net.ID] = &net
+}
+
+// AddBuildCache stores a build cache record.
+func (f *Fake) AddBuildCache(record types.BuildCache) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buildCache = append(f.buildCache, &record)
+}
+
+// CreateContainer stores the container and emits "create".
+func (f *Fake) CreateContainer(ct types.ContainerJSON) {
+	f.AddContainer(ct)
+	f.EmitContainerEvent("create", ct.ID, nil)
+}
+
+// StartContainer marks the container running and emits "start".
+func (f *Fake) StartContainer(id string) error {
+	if err := f.setState(id, "running", 0); err != nil {
+		return err
+	}
+	f.EmitContainerEvent("start", id, nil)
+	return nil
+}
+
+// StopContainer marks the container exited and emits "die" with the exit
+// code and, if not zero, the signal it was killed with.
+func (f *Fake) StopContainer(id string, exitCode int, signal int) error {
+	if err := f.setState(id, "exited", exitCode); err != nil {
+		return err
+	}
+	attributes := map[string]string{"exitCode": strconv.Itoa(exitCode)}
+	if signal != 0 {
+		attributes["signal"] = strconv.Itoa(signal)
+	}
+	f.EmitContainerEvent("die", id, attributes)
+	return nil
+}
+
+// DestroyContainer removes the container and emits "destroy".
+func (f *Fake) DestroyContainer(id string) error {
+	return f.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{})
+}
+
+func (f *Fake) setState(id string, status string, exitCode int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ct, err := f.findContainer(id)
+	if err != nil {
+		return err
+	}
+	ct.State.Status = status
+	ct.State.Running = status == "running"
+	ct.State.ExitCode = exitCode
+	return nil
+}
+
+// EmitContainerEvent emits a container event with the attributes dockerd
+// sends: name, image and labels, plus the given extra attributes.
+func (f *Fake) EmitContainerEvent(action string, id string, extra map[string]string) {
+	f.mu.Lock()
+	attributes := make(map[string]string)
+	if ct, ok := f.containers[id]; ok {
+		for k, v := range ct.Config.Labels {
+			attributes[k] = v
+		}
+		attributes["name"] = strings.TrimPrefix(ct.Name, "/")
+		attributes["image"] = ct.Config.Image
+	}
+	f.mu.Unlock()
+	for k, v := range extra {
+		attributes[k] = v
+	}
+	f.Emit(events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  events.Actor{ID: id, Attributes: attributes},
+	})
+}
+
+// Emit records the event and delivers it to all subscribers. The time is
+// filled in if not set.
+func (f *Fake) Emit(msg events.Message) {
+	if msg.TimeNano == 0 {
+		msg.TimeNano = time.Now().UnixNano()
+	}
+	msg.Time = msg.TimeNano / int64(time.Second)
+	msg.Status = msg.Action
+	msg.ID = msg.Actor.ID
+	msg.From = msg.Actor.Attributes["image"]
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, msg)
+	for sub := range f.subscribers {
+		if sub.matches(&msg) {
+			sub.push(msg)
+		}
+	}
+}
+
+// Disconnect fails all event subscriptions with err, like a dockerd restart.
+func (f *Fake) Disconnect(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers {
+		sub.fail(err)
+		delete(f.subscribers, sub)
+	}
+}
+
+// findContainer accepts an id, a unique id prefix or a name. Must be called
+// with f.mu held.
+func (f *Fake) findContainer(ref string) (*types.ContainerJSON, error) {
+	if ct, ok := f.containers[ref]; ok {
+		return ct, nil
+	}
+	var found *types.ContainerJSON
+	for id, ct := range f.containers {
+		if strings.TrimPrefix(ct.Name, "/") == strings.TrimPrefix(ref, "/") {
+			return ct, nil
+		}
+		if ref != "" && strings.HasPrefix(id, ref) {
+			if found != nil {
+				return nil, errdefs.InvalidParameter(fmt.Errorf("multiple IDs found with provided prefix: %s", ref))
+			}
+			found = ct
+		}
+	}
+	if found == nil {
+		return nil, errdefs.NotFound(fmt.Errorf("No such container: %s", ref))
+	}
+	return found, nil
+}
+
+func (f *Fake) findNetwork(ref string) (*types.NetworkResource, error) {
+	for id, net := range f.networks {
+		if id == ref || net.Name == ref {
+			return net, nil
+		}
+	}
+	return nil, errdefs.NotFound(fmt.Errorf("network %s not found", ref))
+}
+
+func (f *Fake) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := []types.Container{}
+	for _, ct := range f.containers {
+		if !options.All && !ct.State.Running {
+			continue
+		}
+		if !options.Filters.ExactMatch("status", ct.State.Status) {
+			continue
+		}
+		if !options.Filters.ExactMatch("ancestor", ct.Config.Image) &&
+			!options.Filters.ExactMatch("ancestor", ct.Image) {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339Nano, ct.Created)
+		result = append(result, types.Container{
+			ID:      ct.ID,
+			Names:   []string{ct.Name},
+			Image:   ct.Config.Image,
+			ImageID: ct.Image,
+			Created: created.Unix(),
+			Labels:  ct.Config.Labels,
+			State:   ct.State.Status,
+		})
+	}
+	// newest first, like dockerd
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created > result[j].Created
+	})
+	if options.Latest && len(result) > 1 {
+		result = result[:1]
+	}
+	return result, nil
+}
+
+func (f *Fake) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ct, err := f.findContainer(container)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	return cloneContainer(ct), nil
+}
+
+// cloneContainer copies the parts of the container the fake modifies.
+func cloneContainer(ct *types.ContainerJSON) types.ContainerJSON {
+	clone := *ct
+	base := *ct.ContainerJSONBase
+	state := *ct.State
+	base.State = &state
+	clone.ContainerJSONBase = &base
+	settings := *ct.NetworkSettings
+	settings.Networks = make(map[string]*network.EndpointSettings)
+	for name, endpoint := range ct.NetworkSettings.Networks {
+		settings.Networks[name] = endpoint
+	}
+	clone.NetworkSettings = &settings
+	return clone
+}
+
+func (f *Fake) ContainerRemove(ctx context.Context, container string, options types.ContainerRemoveOptions) error {
+	f.mu.Lock()
+	ct, err := f.findContainer(container)
+	if err == nil {
+		if ct.State.Running && !options.Force {
+			err = errdefs.Conflict(fmt.Errorf("You cannot remove a running container %s", ct.ID))
+		} else {
+			delete(f.containers, ct.ID)
+		}
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f.Emit(events.Message{
+		Type:   events.ContainerEventType,
+		Action: "destroy",
+		Actor: events.Actor{ID: ct.ID, Attributes: map[string]string{
+			"name":  strings.TrimPrefix(ct.Name, "/"),
+			"image": ct.Config.Image,
+		}},
+	})
+	return nil
+}
+
+func (f *Fake) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := []types.ImageSummary{}
+	for _, img := range f.images {
+		result = append(result, img.Summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created > result[j].Created
+	})
+	return result, nil
+}
+
+func (f *Fake) ImageHistory(ctx context.Context, imageId string) ([]image.HistoryResponseItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img, ok := f.images[imageId]
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("No such image: %s", imageId))
+	}
+	return append([]image.HistoryResponseItem{}, img.History...), nil
+}
+
+func (f *Fake) ImageRemove(ctx context.Context, imageId string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+	f.mu.Lock()
+	img, ok := f.images[imageId]
+	if !ok {
+		f.mu.Unlock()
+		return nil, errdefs.NotFound(fmt.Errorf("No such image: %s", imageId))
+	}
+	if !options.Force {
+		for _, ct := range f.containers {
+			if ct.Image == imageId {
+				f.mu.Unlock()
+				return nil, errdefs.Conflict(fmt.Errorf("image %s is being used by container %s", imageId, ct.ID))
+			}
+		}
+	}
+	delete(f.images, imageId)
+	f.mu.Unlock()
+
+	f.emitImageDelete(img)
+	return []types.ImageDeleteResponseItem{{Deleted: imageId}}, nil
+}
+
+func (f *Fake) emitImageDelete(img *FakeImage) {
+	name := img.Summary.ID
+	if len(img.Summary.RepoTags) > 0 {
+		name = img.Summary.RepoTags[0]
+	}
+	f.Emit(events.Message{
+		Type:   events.ImageEventType,
+		Action: "delete",
+		Actor:  events.Actor{ID: img.Summary.ID, Attributes: map[string]string{"name": name}},
+	})
+}
+
+// ImagesPrune removes dangling images not used by any container. The "until"
+// filter is honoured, other filters are ignored.
+func (f *Fake) ImagesPrune(ctx context.Context, pruneFilter filters.Args) (types.ImagesPruneReport, error) {
+	until, err := untilFilter(pruneFilter)
+	if err != nil {
+		return types.ImagesPruneReport{}, err
+	}
+
+	f.mu.Lock()
+	used := make(map[string]bool)
+	for _, ct := range f.containers {
+		used[ct.Image] = true
+	}
+	report := types.ImagesPruneReport{}
+	var deleted []*FakeImage
+	for id, img := range f.images {
+		dangling := len(img.Summary.RepoTags) == 0 ||
+			(len(img.Summary.RepoTags) == 1 && img.Summary.RepoTags[0] == "<none>:<none>")
+		if !dangling || used[id] || time.Unix(img.Summary.Created, 0).After(until) {
+			continue
+		}
+		delete(f.images, id)
+		deleted = append(deleted, img)
+		report.ImagesDeleted = append(report.ImagesDeleted, types.ImageDeleteResponseItem{Deleted: id})
+		report.SpaceReclaimed += uint64(img.Summary.Size)
+	}
+	f.mu.Unlock()
+
+	for _, img := range deleted {
+		f.emitImageDelete(img)
+	}
+	return report, nil
+}
+
+// DiskUsage only reports the build cache.
+func (f *Fake) DiskUsage(ctx context.Context) (types.DiskUsage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	usage := types.DiskUsage{}
+	for _, record := range f.buildCache {
+		r := *record
+		usage.BuildCache = append(usage.BuildCache, &r)
+		usage.BuilderSize += record.Size
+	}
+	return usage, nil
+}
+
+// BuildCachePrune removes build cache records last used before "until".
+func (f *Fake) BuildCachePrune(ctx context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error) {
+	until, err := untilFilter(opts.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	report := &types.BuildCachePruneReport{}
+	var kept []*types.BuildCache
+	for _, record := range f.buildCache {
+		lastUsed := record.CreatedAt
+		if record.LastUsedAt != nil {
+			lastUsed = *record.LastUsedAt
+		}
+		if record.InUse || lastUsed.After(until) {
+			kept = append(kept, record)
+			continue
+		}
+		report.CachesDeleted = append(report.CachesDeleted, record.ID)
+		report.SpaceReclaimed += uint64(record.Size)
+	}
+	f.buildCache = kept
+	return report, nil
+}
+
+func untilFilter(args filters.Args) (time.Time, error) {
+	values := args.Get("until")
+	if len(values) == 0 {
+		return time.Now(), nil
+	}
+	d, err := time.ParseDuration(values[0])
+	if err != nil {
+		return time.Time{}, errdefs.InvalidParameter(err)
+	}
+	return time.Now().Add(-d), nil
+}
+
+func (f *Fake) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := []types.NetworkResource{}
+	for _, net := range f.networks {
+		if !options.Filters.Match("name", net.Name) {
+			continue
+		}
+		result = append(result, *net)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func (f *Fake) NetworkInspect(ctx context.Context, network string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	net, err := f.findNetwork(network)
+	if err != nil {
+		return types.NetworkResource{}, err
+	}
+	return *net, nil
+}
+
+func (f *Fake) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	f.mu.Lock()
+	if _, err := f.findNetwork(name); err == nil && options.CheckDuplicate {
+		f.mu.Unlock()
+		return types.NetworkCreateResponse{}, errdefs.Conflict(fmt.Errorf("network with name %s already exists", name))
+	}
+	net := &types.NetworkResource{
+		ID:         f.newId(),
+		Name:       name,
+		Created:    time.Now(),
+		Driver:     options.Driver,
+		EnableIPv6: options.EnableIPv6,
+		Options:    options.Options,
+		Labels:     options.Labels,
+		Containers: make(map[string]types.EndpointResource),
+	}
+	if options.IPAM != nil {
+		net.IPAM = *options.IPAM
+	}
+	f.networks[net.ID] = net
+	f.mu.Unlock()
+
+	f.emitNetworkEvent("create", net, "")
+	return types.NetworkCreateResponse{ID: net.ID}, nil
+}
+
+func (f *Fake) NetworkConnect(ctx context.Context, networkRef, containerRef string, config *network.EndpointSettings) error {
+	f.mu.Lock()
+	net, err := f.findNetwork(networkRef)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	ct, err := f.findContainer(containerRef)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	if _, exists := ct.NetworkSettings.Networks[net.Name]; exists {
+		f.mu.Unlock()
+		return errdefs.Forbidden(fmt.Errorf("container %s is already attached to network %s", ct.ID, net.Name))
+	}
+	endpoint := &network.EndpointSettings{}
+	if config != nil {
+		*endpoint = *config
+	}
+	endpoint.NetworkID = net.ID
+	ct.NetworkSettings.Networks[net.Name] = endpoint
+	net.Containers[ct.ID] = types.EndpointResource{Name: strings.TrimPrefix(ct.Name, "/")}
+	f.mu.Unlock()
+
+	f.emitNetworkEvent("connect", net, ct.ID)
+	return nil
+}
+
+func (f *Fake) NetworkDisconnect(ctx context.Context, networkRef, containerRef string, force bool) error {
+	f.mu.Lock()
+	net, err := f.findNetwork(networkRef)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	ct, err := f.findContainer(containerRef)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	if _, exists := ct.NetworkSettings.Networks[net.Name]; !exists {
+		f.mu.Unlock()
+		return errdefs.Forbidden(fmt.Errorf("container %s is not connected to network %s", ct.ID, net.Name))
+	}
+	delete(ct.NetworkSettings.Networks, net.Name)
+	delete(net.Containers, ct.ID)
+	f.mu.Unlock()
+
+	f.emitNetworkEvent("disconnect", net, ct.ID)
+	return nil
+}
+
+func (f *Fake) emitNetworkEvent(action string, net *types.NetworkResource, cid string) {
+	attributes := map[string]string{"name": net.Name, "type": net.Driver}
+	if cid != "" {
+		attributes["container"] = cid
+	}
+	f.Emit(events.Message{
+		Type:   events.NetworkEventType,
+		Action: action,
+		Actor:  events.Actor{ID: net.ID, Attributes: attributes},
+	})
+}
+
+// Events replays recorded events between Since and Until. Without Until the
+// subscription stays open and receives new events until the context is
+// cancelled or Disconnect is called. Only the "type" filter is supported.
+func (f *Fake) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+
+	since, err := parseEventTime(options.Since, 0)
+	if err == nil {
+		var until int64
+		until, err = parseEventTime(options.Until, -1)
+		if err == nil {
+			go f.serveEvents(ctx, options.Filters, since, until, messages, errs)
+			return messages, errs
+		}
+	}
+	errs <- errdefs.InvalidParameter(err)
+	return messages, errs
+}
+
+func (f *Fake) serveEvents(ctx context.Context, filter filters.Args, since int64, until int64, messages chan events.Message, errs chan error) {
+	sub := &subscriber{
+		filter: filter,
+		notify: make(chan struct{}, 1),
+	}
+	f.mu.Lock()
+	for _, msg := range f.events {
+		if msg.TimeNano >= since && (until < 0 || msg.TimeNano <= until) && sub.matches(&msg) {
+			sub.queue = append(sub.queue, msg)
+		}
+	}
+	if until < 0 {
+		f.subscribers[sub] = true
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.subscribers, sub)
+		f.mu.Unlock()
+	}()
+
+	for {
+		f.mu.Lock()
+		queue := sub.queue
+		sub.queue = nil
+		failure := sub.err
+		f.mu.Unlock()
+
+		for _, msg := range queue {
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+		if failure != nil {
+			errs <- failure
+			return
+		}
+		if until >= 0 {
+			errs <- io.EOF
+			return
+		}
+
+		select {
+		case <-sub.notify:
+		case <-ctx.Done():
+			errs <- ctx.Err()
+			return
+		}
+	}
+}
+
+// parseEventTime accepts the "seconds[.nanoseconds]" format of the Docker
+// API, an empty value results in def.
+func parseEventTime(value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
+	}
+	parts := strings.SplitN(value, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid event time %q", value)
+	}
+	var nsec int64
+	if len(parts) == 2 {
+		frac := (parts[1] + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid event time %q", value)
+		}
+	}
+	return sec*int64(time.Second) + nsec, nil
+}
+
+// subscriber fields other than filter and notify are guarded by Fake.mu.
+type subscriber struct {
+	filter filters.Args
+	notify chan struct{}
+	queue  []events.Message
+	err    error
+}
+
+func (s *subscriber) matches(msg *events.Message) bool {
+	return s.filter.ExactMatch("type", msg.Type)
+}
+
+func (s *subscriber) push(msg events.Message) {
+	s.queue = append(s.queue, msg)
+	s.wake()
+}
+
+func (s *subscriber) fail(err error) {
+	s.err = err
+	s.wake()
+}
+
+func (s *subscriber) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/plugins"
+)
+
+var (
+	healthMaxEventAge = kingpin.Flag(
+		"health-max-event-age",
+		"Report unhealthy if no docker event was received for this long (0 disables the check).",
+	).Default("0s").Duration()
+)
+
+// streamGracePeriod is how long the event stream may be disconnected before
+// it is reported as unhealthy. Reconnects are attempted every 5 seconds.
+const streamGracePeriod = time.Minute
+
+var startup struct {
+	sync.Mutex
+	finished bool
+}
+
+// registerHealthChecks adds the checks of the daemon itself, plugins add
+// their own.
+func registerHealthChecks() {
+	plugins.AddHealthCheck("startup", plugins.Readiness, func() (string, error) {
+		startup.Lock()
+		defer startup.Unlock()
+		if !startup.finished {
+			return "", errors.New("plugins are starting")
+		}
+		return "plugins started", nil
+	})
+	plugins.AddHealthCheck("docker-events", plugins.Liveness, eventStreamHealth)
+	plugins.AddHealthCheck("plugins", plugins.Liveness, pluginsHealth)
+}
+
+// pluginsHealth fails while plugins are disabled by their breaker.
+func pluginsHealth() (string, error) {
+	var disabled []string
+	for _, p := range activePlugins {
+		if _, until := dispatcher.breakers[p].state(); !until.IsZero() {
+			disabled = append(disabled, pluginName(p)+" until "+until.Format(time.RFC3339))
+		}
+	}
+	if len(disabled) > 0 {
+		return "", errors.New("disabled after repeated failures: " + strings.Join(disabled, ", "))
+	}
+	return fmt.Sprintf("%d plugins enabled", len(activePlugins)), nil
+}
+
+func setStartupFinished() {
+	startup.Lock()
+	startup.finished = true
+	startup.Unlock()
+}
+
+func eventStreamHealth() (string, error) {
+	streamStatus.Lock()
+	defer streamStatus.Unlock()
+	if !streamStatus.connected {
+		message := "disconnected since " + streamStatus.since.Format(time.RFC3339)
+		if time.Since(streamStatus.since) > streamGracePeriod {
+			return "", errors.New(message)
+		}
+		return message, nil
+	}
+	maxAge := getSettings().healthMaxEventAge
+	if streamStatus.lastEvent.IsZero() {
+		if maxAge > 0 && time.Since(startTime) > maxAge {
+			return "", errors.New("no events since start")
+		}
+		return "connected, no events yet", nil
+	}
+	age := time.Since(streamStatus.lastEvent).Round(time.Second)
+	if maxAge > 0 && age > maxAge {
+		return "", fmt.Errorf("no events for %s", age)
+	}
+	return fmt.Sprintf("connected, last event %s ago", age), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/plugins"
+)
+
+// usage replaces the default --help output, so that the flags of each plugin
+// are listed in a separate section. Help for a subcommand is left to kingpin.
+func usage(c *kingpin.ParseContext) error {
+	if c.SelectedCommand != nil {
+		return nil
+	}
+	app := kingpin.CommandLine.Model()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "usage: %s %s", app.Name, app.FlagSummary())
+	if len(app.Commands) > 0 {
+		fmt.Fprint(w, " <command> [<args> ...]")
+	}
+	fmt.Fprint(w, "\n\n")
+
+	owner := make(map[string]string)
+	for _, r := range plugins.Registered() {
+		for _, name := range r.Flags {
+			owner[name] = r.Name
+		}
+	}
+	var general []*kingpin.FlagModel
+	for _, flag := range app.Flags {
+		if owner[flag.Name] == "" {
+			general = append(general, flag)
+		}
+	}
+	writeFlags(w, "Flags:", general)
+
+	for _, r := range plugins.Registered() {
+		var flags []*kingpin.FlagModel
+		for _, flag := range app.Flags {
+			if owner[flag.Name] == r.Name {
+				flags = append(flags, flag)
+			}
+		}
+		writeFlags(w, fmt.Sprintf("Plugin %s: %s", r.Name, r.Description), flags)
+	}
+
+	var commands []*kingpin.CmdModel
+	for _, cmd := range app.Commands {
+		if !cmd.Hidden {
+			commands = append(commands, cmd)
+		}
+	}
+	if len(commands) > 0 {
+		fmt.Fprint(w, "Commands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "  %s\t%s\n", cmd.FullCommand, cmd.Help)
+		}
+		fmt.Fprint(w, "\n")
+	}
+
+	w.Flush()
+	os.Exit(0)
+	return nil
+}
+
+func writeFlags(w io.Writer, title string, flags []*kingpin.FlagModel) {
+	fmt.Fprintln(w, title)
+	for _, flag := range flags {
+		if flag.Hidden {
+			continue
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", formatFlag(flag), flag.Help)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func formatFlag(flag *kingpin.FlagModel) string {
+	s := fmt.Sprintf("    --%s", flag.Name)
+	if flag.Short != 0 {
+		s = fmt.Sprintf("-%c, --%s", flag.Short, flag.Name)
+	}
+	if !flag.IsBoolFlag() {
+		s += "=" + flag.FormatPlaceHolder()
+	}
+	if v, ok := flag.Value.(interface{ IsCumulative() bool }); ok && v.IsCumulative() {
+		s += " ..."
+	}
+	return s
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/journal"
+)
+
+var (
+	journalMaxSize = kingpin.Flag(
+		"journal-max-size",
+		"Size at which the journal file is rotated.",
+	).Default("10MB").Bytes()
+	journalMaxFiles = kingpin.Flag(
+		"journal-max-files",
+		"Number of rotated journal files to keep.",
+	).Default("5").Int()
+
+	journalCmd = kingpin.Command(
+		"journal",
+		"Show the journal of docker events and plugin actions.",
+	)
+	journalContainer = journalCmd.Flag(
+		"container",
+		"Only entries for the container with this name or id.",
+	).String()
+	journalImage = journalCmd.Flag(
+		"image",
+		"Only entries for the image with this name, tag or id.",
+	).String()
+	journalSince = journalCmd.Flag(
+		"since",
+		"Only entries after this time (RFC 3339) or duration before now.",
+	).String()
+	journalUntil = journalCmd.Flag(
+		"until",
+		"Only entries before this time (RFC 3339) or duration before now.",
+	).String()
+	journalJson = journalCmd.Flag(
+		"json",
+		"Print entries as JSON lines.",
+	).Bool()
+)
+
+func journalFile(stateDir string) string {
+	return stateDir + "journal.jsonl"
+}
+
+func openJournal(stateDir string) *journal.Journal {
+	j, err := journal.Open(journalFile(stateDir), int64(*journalMaxSize), *journalMaxFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	journal.SetDefault(j)
+	return j
+}
+
+// journalEvent records a docker event received from the stream.
+func journalEvent(event *events.Message) {
+	e := journal.Entry{
+		Time:    time.Unix(0, event.TimeNano),
+		Kind:    "event",
+		Action:  event.Type + " " + event.Action,
+		Details: make(map[string]string),
+	}
+	attributes := event.Actor.Attributes
+	switch event.Type {
+	case "container":
+		e.Cid = event.Actor.ID
+		e.Cname = attributes["name"]
+		e.Image = attributes["image"]
+		for _, key := range []string{"exitCode", "signal", "oldName"} {
+			if value, ok := attributes[key]; ok {
+				e.Details[key] = value
+			}
+		}
+	case "image":
+		e.Image = event.Actor.ID
+		e.Details["name"] = attributes["name"]
+	case "network":
+		e.Cid = attributes["container"]
+		e.Details["network"] = attributes["name"]
+	}
+	journal.Record(e)
+}
+
+func queryJournal(stateDir string) error {
+	filter := journal.Filter{
+		Container: *journalContainer,
+		Image:     *journalImage,
+	}
+	var err error
+	if filter.Since, err = parseJournalTime(*journalSince); err != nil {
+		return err
+	}
+	if filter.Until, err = parseJournalTime(*journalUntil); err != nil {
+		return err
+	}
+
+	if *journalJson {
+		enc := json.NewEncoder(os.Stdout)
+		return journal.Read(journalFile(stateDir), filter, func(e *journal.Entry) error {
+			return enc.Encode(e)
+		})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tKIND\tPLUGIN\tACTION\tCONTAINER\tIMAGE\tOUTCOME\tDETAILS")
+	err = journal.Read(journalFile(stateDir), filter, func(e *journal.Entry) error {
+		container := e.Cname
+		if e.Cid != "" {
+			container = strings.TrimSpace(container + " " + shortId(e.Cid))
+		}
+		outcome := e.Outcome
+		if e.Error != "" {
+			outcome += ": " + e.Error
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format(time.RFC3339), e.Kind, orDash(e.Plugin), e.Action,
+			orDash(container), orDash(e.Image), orDash(outcome), formatDetails(e.Details))
+		return err
+	})
+	w.Flush()
+	return err
+}
+
+// parseJournalTime accepts RFC 3339 times and durations before now.
+func parseJournalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q, expected RFC 3339 time or duration", value)
+	}
+	return t, nil
+}
+
+func formatDetails(details map[string]string) string {
+	keys := make([]string, 0, len(details))
+	for k := range details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + details[k]
+	}
+	return strings.Join(parts, " ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,205 @@
+// Package journal keeps an append-only record of the docker events received
+// and the actions taken by plugins, one JSON object per line.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Entry is a single journal record.
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Kind    string            `json:"kind"` // "event" or "action"
+	Plugin  string            `json:"plugin,omitempty"`
+	Action  string            `json:"action"`
+	Cid     string            `json:"cid,omitempty"`
+	Cname   string            `json:"cname,omitempty"`
+	Image   string            `json:"image,omitempty"`
+	Outcome string            `json:"outcome,omitempty"` // "ok", "error" or "dry-run", for actions
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Journal appends entries to a file, which is rotated to <file>.1, <file>.2,
+// ... when it grows over maxSize. At most maxFiles rotated files are kept.
+type Journal struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+	file     *os.File // nil if reopening after a rotation failed
+	size     int64
+	closed   bool
+}
+
+func Open(path string, maxSize int64, maxFiles int) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	j.file = file
+	j.size = info.Size()
+	return nil
+}
+
+// Write appends the entry, rotating the file first if needed.
+func (j *Journal) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return os.ErrClosed
+	}
+	if j.file == nil {
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+	var rotateErr error
+	if j.size > 0 && j.size+int64(len(line)) > j.maxSize {
+		rotateErr = j.rotate()
+		if j.file == nil {
+			return rotateErr
+		}
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("rotating journal: %v", rotateErr)
+	}
+	return err
+}
+
+// rotate moves the current file away and opens a new one. If moving fails,
+// the current file is reopened, so that writing continues and the rotation is
+// retried by the next write.
+func (j *Journal) rotate() error {
+	err := j.file.Close()
+	j.file = nil
+	if err == nil {
+		err = j.shift()
+	}
+	if openErr := j.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+func (j *Journal) shift() error {
+	os.Remove(rotatedPath(j.path, j.maxFiles))
+	for i := j.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(j.path, i), rotatedPath(j.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if j.maxFiles > 0 {
+		if err := os.Rename(j.path, rotatedPath(j.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(j.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func rotatedPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closed = true
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+var (
+	std   *Journal
+	stdMu sync.Mutex
+)
+
+// SetDefault sets the journal used by Record and Action, nil disables
+// journaling.
+func SetDefault(j *Journal) {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	std = j
+}
+
+// Record appends the entry to the default journal, with the time filled in if
+// not set. Failures are logged.
+func Record(e Entry) {
+	stdMu.Lock()
+	j := std
+	stdMu.Unlock()
+	if j == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := j.Write(e); err != nil {
+		log.WithFields(log.Fields{"file": j.path}).Error("Error writing journal: ", err)
+	}
+}
+
+// Action records an action taken by a plugin on the target described by e,
+// err is its outcome.
+func Action(plugin string, action string, e Entry, err error) {
+	e.Kind = "action"
+	e.Plugin = plugin
+	e.Action = action
+	e.Outcome = "ok"
+	if err != nil {
+		e.Outcome = "error"
+		e.Error = err.Error()
+	}
+	Record(e)
+}
+
+// Planned records an action which a plugin did not take because of
+// --dry-run.
+func Planned(plugin string, action string, e Entry) {
+	e.Kind = "action"
+	e.Plugin = plugin
+	e.Action = action
+	e.Outcome = "dry-run"
+	Record(e)
+}
@@ -0,0 +1,58 @@
+package journal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func lines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestRotationFailure(t *testing.T) {
+	path := t.TempDir() + "/journal.jsonl"
+	j, err := Open(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	// the file cannot be renamed over a directory which is not empty
+	if err := os.MkdirAll(rotatedPath(path, 1)+"/busy", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	e := Entry{Kind: "event", Action: "start", Cid: "0123456789abcdef0123456789abcdef"}
+	if err := j.Write(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Write(e); err == nil {
+		t.Error("rotation failure not reported")
+	}
+	if n := lines(t, path); n != 2 {
+		t.Errorf("%d entries written, want 2", n)
+	}
+
+	if err := os.RemoveAll(rotatedPath(path, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Write(e); err != nil {
+		t.Fatalf("rotation not retried: %v", err)
+	}
+	if n := lines(t, path); n != 1 {
+		t.Errorf("%d entries in the new file, want 1", n)
+	}
+	if n := lines(t, rotatedPath(path, 1)); n != 2 {
+		t.Errorf("%d entries in the rotated file, want 2", n)
+	}
+
+	j.Close()
+	if err := j.Write(e); err != os.ErrClosed {
+		t.Errorf("write after close: %v", err)
+	}
+}
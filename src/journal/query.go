@@ -0,0 +1,128 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Filter selects journal entries, empty fields match everything.
+type Filter struct {
+	Container string // name, id or id prefix
+	Image     string // name, tag, id or id prefix
+	Since     time.Time
+	Until     time.Time
+}
+
+func (f *Filter) Match(e *Entry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.Container != "" &&
+		e.Cname != f.Container &&
+		!(e.Cid != "" && strings.HasPrefix(e.Cid, f.Container)) {
+		return false
+	}
+	if f.Image != "" && !matchImage(e, f.Image) {
+		return false
+	}
+	return true
+}
+
+func matchImage(e *Entry, image string) bool {
+	if e.Image == image {
+		return true
+	}
+	id := strings.TrimPrefix(image, "sha256:")
+	if id != "" && strings.HasPrefix(strings.TrimPrefix(e.Image, "sha256:"), id) {
+		return true
+	}
+	for _, tag := range strings.Split(e.Details["tags"], ",") {
+		if tag != "" && tag == image {
+			return true
+		}
+	}
+	return false
+}
+
+// Read calls fn for the entries of the journal at path matching the filter,
+// oldest first, including rotated files.
+func Read(path string, filter Filter, fn func(e *Entry) error) error {
+	files, err := journalFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := readFile(file, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalFiles returns the rotated files, oldest first, and then the
+// current one.
+func journalFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	type rotated struct {
+		path string
+		n    int
+	}
+	list := []rotated{}
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(match, path+"."))
+		if err == nil {
+			list = append(list, rotated{match, n})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].n > list[j].n
+	})
+	files := []string{}
+	for _, r := range list {
+		files = append(files, r.path)
+	}
+	return append(files, path), nil
+}
+
+func readFile(path string, filter Filter, fn func(e *Entry) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// e.g. a line cut short by a crash
+			log.WithFields(log.Fields{"file": path, "line": line}).Warn("Skipping invalid journal entry")
+			continue
+		}
+		if filter.Match(&e) {
+			if err := fn(&e); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
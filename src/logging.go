@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/config"
+	"vastai-helper/src/logging"
+	"vastai-helper/src/plugins"
+)
+
+var (
+	logFormat = kingpin.Flag(
+		"log-format",
+		"Log format: text (logrus text, colored on a terminal), plain (one aligned line per entry), json or logfmt.",
+	).Default("text").Enum("text", "plain", "json", "logfmt")
+	logLevel = kingpin.Flag(
+		"log-level",
+		"Least severe level logged: trace, debug, info, warning, error.",
+	).Default("info").String()
+	pluginLogLevels = config.StringList(kingpin.Flag(
+		"plugin-log-level",
+		"Log level of a single plugin, overriding --log-level (repeatable). Entries without a plugin field need --log-caller.",
+	).PlaceHolder("PLUGIN=LEVEL"))
+	logCaller = kingpin.Flag(
+		"log-caller",
+		"Attribute entries to the plugin whose code logged them, adding a plugin field (costs a stack walk per entry).",
+	).Bool()
+	logOutput = kingpin.Flag(
+		"log-output",
+		"Where to log: stderr, or directly to journald (fields are kept as journal fields) or syslog.",
+	).Default("stderr").Enum("stderr", "journald", "syslog")
+)
+
+// configureLogging applies the logging flags. It is called on startup and
+// reload, and only changes anything if all of them are valid.
+func configureLogging() error {
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return fmt.Errorf("Invalid --log-level: %v", err)
+	}
+	settings := logging.Settings{
+		Format:       *logFormat,
+		Output:       *logOutput,
+		Level:        level,
+		ReportCaller: *logCaller,
+		Packages:     make(map[string]string),
+		PluginLevels: make(map[string]log.Level),
+	}
+	for _, r := range plugins.Registered() {
+		settings.Packages[r.Package] = r.Name
+	}
+	for _, value := range *pluginLogLevels {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid --plugin-log-level %q, expected PLUGIN=LEVEL", value)
+		}
+		if plugins.Lookup(parts[0]) == nil {
+			return fmt.Errorf("Unknown plugin %q in --plugin-log-level", parts[0])
+		}
+		level, err := log.ParseLevel(parts[1])
+		if err != nil {
+			return fmt.Errorf("Invalid --plugin-log-level %q: %v", value, err)
+		}
+		settings.PluginLevels[parts[0]] = level
+	}
+	return logging.Configure(settings)
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newFormatter(format string, output string) (log.Formatter, error) {
+	switch format {
+	case "", "text":
+		if output == "" || output == "stderr" {
+			return &stderrFormatter{
+				TextFormatter: log.TextFormatter{CallerPrettyfier: hideCaller},
+				logger:        &log.Logger{Out: os.Stderr},
+			}, nil
+		}
+		return &log.TextFormatter{CallerPrettyfier: hideCaller}, nil
+	case "plain":
+		return plainFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{CallerPrettyfier: hideCaller}, nil
+	case "logfmt":
+		return &log.TextFormatter{
+			DisableColors:    true,
+			FullTimestamp:    true,
+			QuoteEmptyFields: true,
+			CallerPrettyfier: hideCaller,
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown log format %q", format)
+}
+
+// hideCaller keeps the caller, which is only recorded to attribute entries
+// to plugins, out of the formatted entries.
+func hideCaller(*runtime.Frame) (string, string) {
+	return "", ""
+}
+
+// stderrFormatter formats entries exactly like the standard logger did when
+// it wrote to stderr itself, colored if stderr is a terminal. The logger is
+// only there for the terminal check of the TextFormatter.
+type stderrFormatter struct {
+	log.TextFormatter
+	logger *log.Logger
+}
+
+func (f *stderrFormatter) Format(entry *log.Entry) ([]byte, error) {
+	e := *entry
+	e.Logger = f.logger
+	return f.TextFormatter.Format(&e)
+}
+
+// plainFormatter writes one line for humans per entry:
+//
+//	2021-06-01 12:00:00 INFO  Attaching container  cid=0123456789ab cname=C.1234
+type plainFormatter struct{}
+
+func (plainFormatter) Format(entry *log.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(entry.Time.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&b, " %-5s ", strings.ToUpper(entry.Level.String()))
+	b.WriteString(entry.Message)
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i == 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, " %s=%s", key, quote(fmt.Sprint(entry.Data[key])))
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+func quote(value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\t\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// discardFormatter is used by the standard logger, which writes nowhere;
+// entries are formatted by the output hook.
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func testEntry(logger *log.Logger, caller bool) *log.Entry {
+	entry := &log.Entry{
+		Logger:  logger,
+		Time:    time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Level:   log.InfoLevel,
+		Message: "Attaching container",
+		Data:    log.Fields{"cid": "0123456789ab", "cname": "C.1234", "net": "vastai net"},
+	}
+	if caller {
+		entry.Caller = &runtime.Frame{Function: "vastai-helper/src/plugins/netattach.attach", File: "net-attach.go", Line: 1}
+	}
+	return entry
+}
+
+// "text" must stay what the standard logger wrote to stderr by itself.
+func TestTextFormatUnchanged(t *testing.T) {
+	reference := log.New()
+	reference.Out = os.Stderr
+	want, err := reference.Formatter.Format(testEntry(reference, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatter, err := newFormatter("text", "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, caller := range []bool{false, true} {
+		logger := log.New()
+		logger.Out = ioutil.Discard
+		logger.ReportCaller = caller
+		got, err := formatter.Format(testEntry(logger, caller))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("caller %v: got %q, want %q", caller, got, want)
+		}
+	}
+}
+
+func TestPlainFormat(t *testing.T) {
+	formatter, err := newFormatter("plain", "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := formatter.Format(testEntry(log.New(), true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2021-06-01 12:00:00 INFO  Attaching container  cid=0123456789ab cname=C.1234 net=\"vastai net\"\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCallerHidden(t *testing.T) {
+	for _, format := range []string{"json", "logfmt"} {
+		formatter, err := newFormatter(format, "journald")
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := log.New()
+		logger.ReportCaller = true
+		got, err := formatter.Format(testEntry(logger, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(got), "net-attach.go") {
+			t.Errorf("%s: caller in %s", format, got)
+		}
+	}
+}
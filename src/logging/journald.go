@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldSink sends entries over the native journal protocol, with each
+// logrus field as a journal field: cid becomes CID, so that
+// "journalctl CID=0123456789ab" finds the entries of a container.
+type journaldSink struct {
+	conn net.Conn
+}
+
+func openJournald() (*journaldSink, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to journald: %v", err)
+	}
+	return &journaldSink{conn: conn}, nil
+}
+
+func (j *journaldSink) write(entry *log.Entry, formatted []byte) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(int(syslogSeverity(entry.Level))))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", identifier())
+	if entry.Caller != nil {
+		writeJournalField(&b, "CODE_FUNC", entry.Caller.Function)
+		writeJournalField(&b, "CODE_FILE", entry.Caller.File)
+		writeJournalField(&b, "CODE_LINE", strconv.Itoa(entry.Caller.Line))
+	}
+	for key, value := range entry.Data {
+		writeJournalField(&b, journalFieldName(key), fmt.Sprint(value))
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+func (j *journaldSink) close() error {
+	return j.conn.Close()
+}
+
+// writeJournalField uses the binary form for values spanning several lines:
+// the name, a newline, the little endian 64 bit length and the value.
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	b.WriteString(name)
+	if strings.ContainsRune(value, '\n') {
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	} else {
+		b.WriteByte('=')
+	}
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// reservedFields are set from the entry itself.
+var reservedFields = map[string]bool{
+	"MESSAGE":           true,
+	"PRIORITY":          true,
+	"SYSLOG_IDENTIFIER": true,
+	"CODE_FUNC":         true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+}
+
+// journalFieldName maps a logrus field to a valid journal field name:
+// uppercase letters, digits and underscores, not starting with an underscore
+// or a digit.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] <= '9' || reservedFields[name] {
+		name = "FIELD_" + name
+	}
+	return name
+}
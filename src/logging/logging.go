@@ -0,0 +1,163 @@
+// Package logging sets the format, levels and destination of the logrus
+// standard logger, which every package of the daemon logs to.
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Settings describe how entries are logged.
+type Settings struct {
+	Format string // "text", "plain", "json" or "logfmt"
+	Output string // "stderr", "journald" or "syslog"
+	Level  log.Level
+	// ReportCaller attributes entries without a plugin field to the plugin
+	// whose package logged them, which costs a stack walk per entry.
+	ReportCaller bool
+	// Packages maps the import path of each plugin package to the plugin
+	// name, so that entries logged by a plugin can be attributed to it.
+	Packages map[string]string
+	// PluginLevels override Level for entries of the named plugins.
+	PluginLevels map[string]log.Level
+}
+
+// sink writes an entry to its destination. formatted is the entry in the
+// configured format, sinks which keep fields separately can ignore it.
+type sink interface {
+	write(entry *log.Entry, formatted []byte) error
+	close() error
+}
+
+// output is installed as the only hook of the standard logger, which itself
+// writes nowhere. Unlike the logger, it can filter entries per plugin.
+type output struct {
+	mu        sync.Mutex
+	settings  Settings
+	formatter log.Formatter
+	sink      sink
+}
+
+var current *output
+
+// Configure applies the settings. It can be called again on reload, the
+// previous sink is closed once the new one is in place. On error nothing is
+// changed.
+func Configure(s Settings) error {
+	formatter, err := newFormatter(s.Format, s.Output)
+	if err != nil {
+		return err
+	}
+	var snk sink
+	switch s.Output {
+	case "", "stderr":
+		snk = &stderrSink{}
+	case "journald":
+		snk, err = openJournald()
+	case "syslog":
+		snk, err = openSyslog()
+	default:
+		err = fmt.Errorf("Unknown log output %q", s.Output)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the logger drops entries before hooks see them, so it has to let
+	// through the most verbose level in use
+	level := s.Level
+	for _, l := range s.PluginLevels {
+		if l > level {
+			level = l
+		}
+	}
+
+	o := &output{settings: s, formatter: formatter, sink: snk}
+	std := log.StandardLogger()
+	std.SetFormatter(discardFormatter{})
+	std.SetOutput(ioutil.Discard)
+	std.SetReportCaller(s.ReportCaller)
+	std.SetLevel(level)
+	hooks := make(log.LevelHooks)
+	hooks.Add(o)
+	previous := current
+	std.ReplaceHooks(hooks)
+	current = o
+	if previous != nil {
+		previous.mu.Lock()
+		previous.sink.close()
+		previous.mu.Unlock()
+	}
+	return nil
+}
+
+func (o *output) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (o *output) Fire(entry *log.Entry) error {
+	plugin, _ := entry.Data["plugin"].(string)
+	if plugin == "" && entry.Caller != nil {
+		// entries are copied for each call, the field is not shared
+		if plugin = o.settings.Packages[packageOf(entry.Caller.Function)]; plugin != "" {
+			entry.Data["plugin"] = plugin
+		}
+	}
+	level := o.settings.Level
+	if l, ok := o.settings.PluginLevels[plugin]; ok {
+		level = l
+	}
+	if entry.Level > level {
+		return nil
+	}
+
+	formatted, err := o.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sink.write(entry, formatted)
+}
+
+// CallerPackage returns the import path of the package of the function
+// skip frames above the caller.
+func CallerPackage(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	return packageOf(runtime.FuncForPC(pc).Name())
+}
+
+// packageOf strips the function and receiver from a qualified function name
+// like "vastai-helper/src/plugins/netattach.(*NetAttach).Start".
+func packageOf(function string) string {
+	slash := strings.LastIndex(function, "/")
+	if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+		return function[:slash+1+dot]
+	}
+	return function
+}
+
+func identifier() string {
+	return filepath.Base(os.Args[0])
+}
+
+type stderrSink struct{}
+
+func (s *stderrSink) write(entry *log.Entry, formatted []byte) error {
+	_, err := os.Stderr.Write(formatted)
+	return err
+}
+
+func (s *stderrSink) close() error {
+	return nil
+}
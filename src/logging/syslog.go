@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"log/syslog"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syslogSink sends formatted entries to the local syslog daemon. Fields are
+// part of the message, --log-format=json keeps them easy to parse.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func openSyslog() (*syslogSink, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, identifier())
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) write(entry *log.Entry, formatted []byte) error {
+	message := strings.TrimSuffix(string(formatted), "\n")
+	switch syslogSeverity(entry.Level) {
+	case syslog.LOG_CRIT:
+		return s.writer.Crit(message)
+	case syslog.LOG_ERR:
+		return s.writer.Err(message)
+	case syslog.LOG_WARNING:
+		return s.writer.Warning(message)
+	case syslog.LOG_INFO:
+		return s.writer.Info(message)
+	}
+	return s.writer.Debug(message)
+}
+
+func (s *syslogSink) close() error {
+	return s.writer.Close()
+}
+
+// syslogSeverity is also the journal priority.
+func syslogSeverity(level log.Level) syslog.Priority {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return syslog.LOG_CRIT
+	case log.ErrorLevel:
+		return syslog.LOG_ERR
+	case log.WarnLevel:
+		return syslog.LOG_WARNING
+	case log.InfoLevel:
+		return syslog.LOG_INFO
+	}
+	return syslog.LOG_DEBUG
+}
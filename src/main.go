@@ -2,49 +2,314 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
-
-	"github.com/docker/docker/client"
 	"gopkg.in/alecthomas/kingpin.v2"
 
-	apiPlugin "vastai-helper/src/plugins/api"
-	autoPrunePlugin "vastai-helper/src/plugins/autoprune"
-	netAttachPlugin "vastai-helper/src/plugins/netattach"
+	"vastai-helper/src/config"
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/plugins"
+	_ "vastai-helper/src/plugins/api"
+	_ "vastai-helper/src/plugins/autoprune"
+	"vastai-helper/src/plugins/netattach"
+	_ "vastai-helper/src/plugins/webhook"
+	"vastai-helper/src/rules"
+	"vastai-helper/src/sdnotify"
+	"vastai-helper/src/statedir"
+)
+
+const defaultConfigFile = "/etc/vastai-helper/config.yaml"
+
+var (
+	configFile = kingpin.Flag(
+		"config",
+		"Configuration file, settings in it override the command line flags.",
+	).Default(defaultConfigFile).String()
+	stateDirFlag = kingpin.Flag(
+		"state-dir",
+		"Directory for leases, prune state, the journal and spooled notifications.",
+	).Default("/var/lib/vastai-helper").String()
+	shutdownTimeout = kingpin.Flag(
+		"shutdown-timeout",
+		"Time to wait for plugins to finish on shutdown.",
+	).Default("30s").Duration()
+	enablePlugins = config.StringList(kingpin.Flag(
+		"enable-plugin",
+		"Run only the given plugin (repeatable). All plugins are run by default.",
+	).PlaceHolder("PLUGIN"))
+	disablePlugins = config.StringList(kingpin.Flag(
+		"disable-plugin",
+		"Do not run the given plugin (repeatable).",
+	).PlaceHolder("PLUGIN"))
+
+	runCmd = kingpin.Command(
+		"run",
+		"Run the daemon (default).",
+	).Default()
 )
 
-func createDockerClient() *client.Client {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+func createDockerClient() dockerapi.Client {
+	cli, err := dockerapi.New()
 	if err != nil {
 		log.Fatal(err)
 	}
 	return cli
 }
 
-var plugins []Plugin
+var activePlugins []plugins.Plugin
+var pluginNames = make(map[plugins.Plugin]string)
+var dispatcher *Dispatcher
+var cfg *config.Config
+var adminServer *http.Server
+
+// reloadRequests are handled by the event loop, so that settings only change
+// while no plugin is starting or stopping.
+var reloadRequests = make(chan struct{}, 1)
+
+// reconcileRequests come from the admin socket, the result of the pass is
+// sent back on the channel.
+var reconcileRequests = make(chan chan error)
 
 func main() {
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	kingpin.HelpFlag.Short('h').PreAction(usage)
+	command := kingpin.Parse()
+
+	cfg = config.New(kingpin.CommandLine, *configFile)
+	if err := cfg.Load(*configFile != defaultConfigFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := rules.Load(); err != nil {
+		log.Fatal(err)
+	}
+	loadSettings()
+	// plugins append file names to the directory
+	stateDir := strings.TrimRight(*stateDirFlag, "/") + "/"
+
+	switch command {
+	case journalCmd.FullCommand():
+		if err := queryJournal(stateDir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case statusCmd.FullCommand(), pruneCmd.FullCommand(), leasesCmd.FullCommand(),
+		attachmentsCmd.FullCommand(), reconcileCmd.FullCommand():
+		if err := runAdminCommand(command); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := configureLogging(); err != nil {
+		log.Fatal(err)
+	}
+
+	// the self-test runs next to the daemon, which holds the lock and writes
+	// the journal
+	if !netattach.SelfTestRequested() {
+		lock, err := statedir.Acquire(stateDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lock.Release()
+		if err := statedir.Migrate(stateDir); err != nil {
+			log.Fatal(err)
+		}
+		j := openJournal(stateDir)
+		defer j.Close()
+	}
 
 	cli := createDockerClient()
-	ctx := context.Background()
-	stateDir := "/var/lib/vastai-helper/"
+	ctx, cancel := context.WithCancel(context.Background())
+	go handleSignals(cancel)
 
-	plugins = []Plugin{
-		autoPrunePlugin.NewPlugin(ctx, cli, stateDir),
-		apiPlugin.NewPlugin(ctx, cli),
-		netAttachPlugin.NewPlugin(ctx, cli, stateDir),
+	selected, err := selectPlugins()
+	if err != nil {
+		log.Fatal(err)
+	}
+	registerHealthChecks()
+	for _, r := range selected {
+		p := r.New(ctx, cli, stateDir)
+		activePlugins = append(activePlugins, p)
+		pluginNames[p] = r.Name
+	}
+	log.WithFields(log.Fields{"plugins": selectedNames(selected)}).Info("Starting plugins")
+	setStatus("Starting plugins")
+	if plugins.DryRun() {
+		log.Warn("Dry run: plugins only log the changes they would make")
 	}
+	// plugin calls are not cancelled on shutdown, but allowed to finish
+	dispatcher = newDispatcher(context.Background(), activePlugins, *dispatchWorkers, *dispatchQueueSize, *pluginTimeout)
+	plugins.SetNotifier(deliverNotice)
+	plugins.SetPanicHandler(backgroundPanicked)
 
 	if err := discoverContainers(ctx, cli); err != nil {
 		log.Fatal(err)
 	}
-	for _, plugin := range plugins {
-		if err := plugin.Start(); err != nil {
+	dispatcher.wait()
+	for _, plugin := range activePlugins {
+		if err := protect(plugin, plugin.Start); err != nil {
 			log.Fatal(err)
 		}
 	}
+	loadKnownContainers()
+	if err := reconcileContainers(ctx, cli); err != nil {
+		log.Error(err)
+	}
+	adminServer = startAdminServer(ctx)
+	setStartupFinished()
+	notifySystemd(sdnotify.Ready())
+	go runWatchdog(ctx)
 
 	dockerEventLoop(ctx, cli)
+	shutdown()
+}
+
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopping := false
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			select {
+			case reloadRequests <- struct{}{}:
+			default:
+			}
+		} else if !stopping {
+			log.WithFields(log.Fields{"signal": sig}).Info("Shutting down")
+			cancel()
+			stopping = true
+		} else {
+			log.WithFields(log.Fields{"signal": sig}).Warn("Forced exit")
+			os.Exit(1)
+		}
+	}
+}
+
+// deliverNotice passes a notice raised by a plugin to the plugins handling
+// notices. Notices are raised by plugin goroutines outside the event loop,
+// possibly while the dispatcher is shutting down, so handlers are called
+// directly instead of being queued.
+func deliverNotice(notice *plugins.Notice) {
+	logger := log.WithFields(log.Fields{"notice": notice.Kind, "from": notice.Plugin})
+	for _, p := range activePlugins {
+		h, ok := p.(plugins.NoticeHandler)
+		if !ok {
+			continue
+		}
+		b := dispatcher.breakers[p]
+		if !b.allow() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), getSettings().pluginTimeout)
+		b.record(protect(p, func() error {
+			err := h.HandleNotice(ctx, notice)
+			if err != nil {
+				pluginFailed(p, err, logger)
+			}
+			return err
+		}))
+		cancel()
+	}
+}
+
+func reloadConfig() {
+	logger := log.WithFields(log.Fields{"file": cfg.Path})
+	logger.Info("Reloading configuration")
+	if err := cfg.Load(*configFile != defaultConfigFile); err != nil {
+		logger.Error(err)
+		return
+	}
+	loadSettings()
+	if err := rules.Load(); err != nil {
+		logger.Error(err)
+	}
+	if err := configureLogging(); err != nil {
+		logger.Error(err)
+	}
+	if selected, err := selectPlugins(); err != nil {
+		logger.Error(err)
+	} else if selectedNames(selected) != activePluginNames() {
+		logger.Warn("Changes to the set of enabled plugins require a restart")
+	}
+	for _, p := range activePlugins {
+		if r, ok := p.(plugins.Reloader); ok {
+			if err := protect(p, r.Reload); err != nil {
+				logger.WithFields(log.Fields{"plugin": pluginName(p)}).Error(err)
+			}
+		}
+	}
+}
+
+// selectPlugins returns the registered plugins enabled by --enable-plugin and
+// --disable-plugin, sorted by name.
+func selectPlugins() ([]*plugins.Registration, error) {
+	enabled := make(map[string]bool)
+	for _, name := range *enablePlugins {
+		if plugins.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown plugin %q in --enable-plugin", name)
+		}
+		enabled[name] = true
+	}
+	disabled := make(map[string]bool)
+	for _, name := range *disablePlugins {
+		if plugins.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown plugin %q in --disable-plugin", name)
+		}
+		disabled[name] = true
+	}
+
+	var selected []*plugins.Registration
+	for _, r := range plugins.Registered() {
+		if (len(enabled) == 0 || enabled[r.Name]) && !disabled[r.Name] {
+			selected = append(selected, r)
+		}
+	}
+	return selected, nil
+}
+
+func selectedNames(list []*plugins.Registration) string {
+	names := make([]string, len(list))
+	for i, r := range list {
+		names[i] = r.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func activePluginNames() string {
+	names := make([]string, len(activePlugins))
+	for i, p := range activePlugins {
+		names[i] = pluginNames[p]
+	}
+	return strings.Join(names, ",")
+}
+
+func shutdown() {
+	notifySystemd(sdnotify.Stopping())
+	setStatus("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Error("Error stopping admin server: ", err)
+		}
+	}
+
+	if err := dispatcher.shutdown(ctx); err != nil {
+		log.Error("Error waiting for plugins: ", err)
+	}
+	// stop in reverse start order
+	for i := len(activePlugins) - 1; i >= 0; i-- {
+		p := activePlugins[i]
+		if err := protect(p, func() error { return p.Stop(ctx) }); err != nil {
+			log.WithFields(log.Fields{"plugin": pluginName(p)}).Error("Error stopping plugin: ", err)
+		}
+	}
+	log.Info("Shutdown complete")
 }
@@ -0,0 +1,252 @@
+// Package metrics implements the counters and gauges exported on /metrics in
+// the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Namespace is prepended to all metric names.
+const Namespace = "vastai_helper_"
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registry   = make(map[string]collector)
+	registryMu sync.Mutex
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[c.name()]; exists {
+		panic(fmt.Sprintf("metric %q registered twice", c.name()))
+	}
+	registry[c.name()] = c
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		sum := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, sum) {
+			return
+		}
+	}
+}
+
+func (v *value) set(x float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(x))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter only goes up.
+type Counter value
+
+func (c *Counter) Inc() {
+	(*value)(c).add(1)
+}
+
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("counter cannot decrease")
+	}
+	(*value)(c).add(delta)
+}
+
+// Gauge can be set to any value.
+type Gauge value
+
+func (g *Gauge) Set(x float64) {
+	(*value)(g).set(x)
+}
+
+func (g *Gauge) Add(delta float64) {
+	(*value)(g).add(delta)
+}
+
+func (g *Gauge) Inc() {
+	(*value)(g).add(1)
+}
+
+func (g *Gauge) Dec() {
+	(*value)(g).add(-1)
+}
+
+// family is a metric with zero or more labels.
+type family struct {
+	metricName string
+	help       string
+	kind       string // "counter" or "gauge"
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*value // by encoded label values
+}
+
+func newFamily(name string, help string, kind string, labels []string) *family {
+	f := &family{
+		metricName: Namespace + name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		series:     make(map[string]*value),
+	}
+	register(f)
+	return f
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) with(values []string) *value {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.series[key]
+	if !ok {
+		v = &value{}
+		f.series[key] = v
+	}
+	return v
+}
+
+func (f *family) write(w io.Writer) {
+	writeHeader(w, f.metricName, f.help, f.kind)
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var values []string
+		if len(f.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		writeSample(w, f.metricName, f.labels, values, f.series[key].get())
+	}
+	f.mu.Unlock()
+}
+
+func NewCounter(name string, help string) *Counter {
+	return (*Counter)(newFamily(name, help, "counter", nil).with(nil))
+}
+
+func NewGauge(name string, help string) *Gauge {
+	return (*Gauge)(newFamily(name, help, "gauge", nil).with(nil))
+}
+
+// CounterVec is a set of counters distinguished by label values.
+type CounterVec struct {
+	f *family
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{newFamily(name, help, "counter", labels)}
+}
+
+// With returns the counter for the label values, given in the order of the
+// label names.
+func (c *CounterVec) With(values ...string) *Counter {
+	return (*Counter)(c.f.with(values))
+}
+
+// GaugeVec is a set of gauges distinguished by label values.
+type GaugeVec struct {
+	f *family
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newFamily(name, help, "gauge", labels)}
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return (*Gauge)(g.f.with(values))
+}
+
+// gaugeFunc is evaluated on every scrape.
+type gaugeFunc struct {
+	metricName string
+	help       string
+	f          func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by f on every
+// scrape. f must be safe for concurrent use.
+func NewGaugeFunc(name string, help string, f func() float64) {
+	register(&gaugeFunc{Namespace + name, help, f})
+}
+
+func (g *gaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	writeSample(w, g.metricName, nil, nil, g.f())
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	help = strings.ReplaceAll(help, `\`, `\\`)
+	help = strings.ReplaceAll(help, "\n", `\n`)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeSample(w io.Writer, name string, labels []string, values []string, v float64) {
+	fmt.Fprint(w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = label + `="` + labelEscaper.Replace(values[i]) + `"`
+		}
+		fmt.Fprint(w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	fmt.Fprintln(w, " "+strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		names := make([]string, 0, len(registry))
+		for name := range registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		collectors := make([]collector, len(names))
+		for i, name := range names {
+			collectors[i] = registry[name]
+		}
+		registryMu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, c := range collectors {
+			c.write(w)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/plugins"
+)
+
+var (
+	eventBufferSize = plugins.Flag(pluginName,
+		"api-event-buffer",
+		"Number of changes kept for /v1/events clients resuming with Last-Event-ID.",
+	).Default("256").Int()
+)
+
+const keepaliveInterval = 30 * time.Second
+
+// Diff is sent by /v1/events when a snapshot differs from the previous one
+// in what /info shows.
+type Diff struct {
+	Generation uint64
+	Containers []ContainerInfo `json:",omitempty"` // added or changed
+	Removed    []string        `json:",omitempty"` // names of removed containers
+	Gpus       []GpuInfo       `json:",omitempty"` // changed
+}
+
+// changeFeed keeps the latest diffs in a ring buffer, so that clients which
+// reconnect can be sent what they missed instead of a full snapshot.
+type changeFeed struct {
+	mu     sync.Mutex
+	size   int // --api-event-buffer, set on reload
+	diffs  []*Diff
+	oldest uint64        // generation before which diffs were dropped
+	added  chan struct{} // closed and replaced when a diff is added
+}
+
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{size: size, added: make(chan struct{})}
+}
+
+// setSize drops the oldest diffs if more than size are kept.
+func (f *changeFeed) setSize(size int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.size = size
+	f.trim(size)
+}
+
+// trim drops the oldest diffs until at most n are kept.
+func (f *changeFeed) trim(n int) {
+	if n < 0 {
+		n = 0
+	}
+	if drop := len(f.diffs) - n; drop > 0 {
+		f.oldest = f.diffs[drop-1].Generation
+		f.diffs = f.diffs[drop:]
+	}
+}
+
+// add must be called in generation order.
+func (f *changeFeed) add(d *Diff) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.trim(f.size - 1)
+	f.diffs = append(f.diffs, d)
+	close(f.added)
+	f.added = make(chan struct{})
+}
+
+// since returns the diffs after the given generation and a channel which is
+// closed when more are added. ok is false if some were dropped already.
+func (f *changeFeed) since(generation uint64) (diffs []*Diff, added <-chan struct{}, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if generation < f.oldest {
+		return nil, f.added, false
+	}
+	for _, d := range f.diffs {
+		if d.Generation > generation {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, f.added, true
+}
+
+// diffSnapshots compares the exposed containers by id and the GPUs by index.
+func diffSnapshots(old *InfoSnapshot, s *InfoSnapshot) *Diff {
+	d := &Diff{Generation: s.Generation}
+	before := make(map[string]*ContainerInfo)
+	for i := range old.Containers {
+		if inst := &old.Containers[i]; inst.shouldExpose() {
+			before[inst.id] = inst
+		}
+	}
+	for i := range s.Containers {
+		inst := &s.Containers[i]
+		if !inst.shouldExpose() {
+			continue
+		}
+		prev, ok := before[inst.id]
+		if ok && prev.Name != inst.Name {
+			d.Removed = append(d.Removed, prev.Name)
+		}
+		if !ok || !reflect.DeepEqual(prev, inst) {
+			d.Containers = append(d.Containers, *inst)
+		}
+		delete(before, inst.id)
+	}
+	for _, inst := range before {
+		d.Removed = append(d.Removed, inst.Name)
+	}
+	for i, gpu := range s.Gpus {
+		if i >= len(old.Gpus) || !sameGpu(old.Gpus[i], gpu) {
+			d.Gpus = append(d.Gpus, gpu)
+		}
+	}
+	return d
+}
+
+// sameGpu ignores the time of the telemetry, so that queries measuring the
+// same values are not sent as changes.
+func sameGpu(a GpuInfo, b GpuInfo) bool {
+	if a.Telemetry != nil && b.Telemetry != nil {
+		ta, tb := *a.Telemetry, *b.Telemetry
+		ta.Updated, tb.Updated = time.Time{}, time.Time{}
+		a.Telemetry, b.Telemetry = &ta, &tb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (d *Diff) empty() bool {
+	return len(d.Containers) == 0 && len(d.Removed) == 0 && len(d.Gpus) == 0
+}
+
+// serveEvents streams changes as server-sent events: a "snapshot" event
+// with the /info document plus Gpus as in /v1/gpus, then a "diff" event per
+// change. Event ids are "EPOCH-GENERATION", the epoch changes when the
+// daemon restarts. A client reconnecting with Last-Event-ID only gets the
+// diffs it missed if the epoch is the same and they are still buffered.
+func (p *ApiPlugin) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	sendSnapshot := true
+	var last uint64
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("lastEventId")
+	}
+	if id, ok := p.cache.parseEventId(lastId); ok && id <= p.cache.Snapshot().Generation {
+		last = id
+		sendSnapshot = false
+	}
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		diffs, added, ok := p.cache.feed.since(last)
+		if sendSnapshot || !ok {
+			s := p.cache.Snapshot()
+			snapshot := struct {
+				*InfoSnapshot
+				Generation uint64
+				Gpus       []GpuInfo
+			}{s.exposed(), s.Generation, s.Gpus}
+			if err := writeEvent(w, "snapshot", p.cache.eventId(s.Generation), &snapshot); err != nil {
+				return
+			}
+			last = s.Generation
+			sendSnapshot = false
+			diffs, added, _ = p.cache.feed.since(last)
+		}
+		for _, d := range diffs {
+			if err := writeEvent(w, "diff", p.cache.eventId(d.Generation), d); err != nil {
+				return
+			}
+			last = d.Generation
+		}
+		flusher.Flush()
+
+		select {
+		case <-added:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (c *InfoCache) eventId(generation uint64) string {
+	return fmt.Sprintf("%s-%d", c.epoch, generation)
+}
+
+// parseEventId returns the generation of an event id of this process.
+func (c *InfoCache) parseEventId(id string) (uint64, bool) {
+	if !strings.HasPrefix(id, c.epoch+"-") {
+		return 0, false
+	}
+	generation, err := strconv.ParseUint(strings.TrimPrefix(id, c.epoch+"-"), 10, 64)
+	return generation, err == nil
+}
+
+func writeEvent(w http.ResponseWriter, event string, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", event, id, data)
+	return err
+}
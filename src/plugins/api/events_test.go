@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vastai-helper/src/dockerapi"
+)
+
+// firstEvent connects to /v1/events and returns the type and id of the
+// first event.
+func firstEvent(t *testing.T, url string, lastId string) (string, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var event, id string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case line == "" && event != "":
+			return event, id
+		}
+	}
+	t.Fatalf("stream ended: %v", scanner.Err())
+	return "", ""
+}
+
+func TestEventIds(t *testing.T) {
+	ctx := context.Background()
+	cli := dockerapi.NewFake()
+	addGpuContainer(cli, "c1", "C.1", "pytorch", "0")
+	addGpuContainer(cli, "c2", "C.2", "pytorch", "1")
+	p := &ApiPlugin{cache: newInfoCache(ctx, cli, fakeSmi(2))}
+	if err := p.cache.updateContainerInfo(ctx, []string{"c1"}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(p.serveEvents))
+	defer server.Close()
+
+	event, id := firstEvent(t, server.URL, "")
+	generation := p.cache.Snapshot().Generation
+	if event != "snapshot" || id != fmt.Sprintf("%s-%d", p.cache.epoch, generation) {
+		t.Fatalf("first event %s %s", event, id)
+	}
+
+	if err := p.cache.updateContainerInfo(ctx, []string{"c2"}); err != nil {
+		t.Fatal(err)
+	}
+	event, next := firstEvent(t, server.URL, id)
+	if event != "diff" || next != fmt.Sprintf("%s-%d", p.cache.epoch, generation+1) {
+		t.Errorf("resumed with %s %s, want the missed diff", event, next)
+	}
+
+	// generations of another process, or ids without an epoch
+	for _, lastId := range []string{"0-" + fmt.Sprint(generation), fmt.Sprint(generation), "garbage"} {
+		if event, _ := firstEvent(t, server.URL, lastId); event != "snapshot" {
+			t.Errorf("resumed from %q with %s, want a snapshot", lastId, event)
+		}
+	}
+}
+
+func TestChangeFeedSize(t *testing.T) {
+	f := newChangeFeed(3)
+	for gen := uint64(1); gen <= 4; gen++ {
+		f.add(&Diff{Generation: gen})
+	}
+	if _, _, ok := f.since(0); ok {
+		t.Error("resumed before the oldest diff kept")
+	}
+	if diffs, _, ok := f.since(1); !ok || len(diffs) != 3 {
+		t.Errorf("resumed with %d diffs (%v), want 3", len(diffs), ok)
+	}
+
+	f.setSize(1)
+	if _, _, ok := f.since(2); ok {
+		t.Error("diffs not dropped when shrinking the buffer")
+	}
+	if diffs, _, ok := f.since(3); !ok || len(diffs) != 1 || diffs[0].Generation != 4 {
+		t.Errorf("resumed with %v (%v), want the last diff", diffs, ok)
+	}
+}
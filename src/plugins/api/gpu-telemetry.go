@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/plugins"
+)
+
+var (
+	nvidiaSmiPath = plugins.Flag(pluginName,
+		"nvidia-smi",
+		"nvidia-smi binary, can be a script printing canned output on hosts without GPUs.",
+	).Default("nvidia-smi").String()
+	telemetryInterval = plugins.Flag(pluginName,
+		"gpu-telemetry-interval",
+		"Interval between GPU telemetry queries (0 disables them).",
+	).Default("30s").Duration()
+)
+
+// telemetryFields are queried in this order, see nvidia-smi --help-query-gpu.
+var telemetryFields = []string{
+	"index",
+	"name",
+	"uuid",
+	"memory.used",
+	"memory.total",
+	"utilization.gpu",
+	"temperature.gpu",
+	"power.draw",
+	"driver_version",
+}
+
+const nvidiaSmiTimeout = 10 * time.Second
+
+// NvidiaSmi runs nvidia-smi with the arguments and returns its output.
+type NvidiaSmi func(ctx context.Context, args ...string) ([]byte, error)
+
+// execNvidiaSmi runs the binary at path.
+func execNvidiaSmi(path string) NvidiaSmi {
+	return func(ctx context.Context, args ...string) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, nvidiaSmiTimeout)
+		defer cancel()
+		return exec.CommandContext(ctx, path, args...).Output()
+	}
+}
+
+// GpuTelemetry is the state of a GPU as reported by nvidia-smi. Values the
+// GPU does not support are null.
+type GpuTelemetry struct {
+	Index         int
+	Name          string
+	Uuid          string
+	MemoryUsed    *int64   // MiB
+	MemoryTotal   *int64   // MiB
+	Utilization   *int     // percent
+	Temperature   *int     // degrees Celsius
+	PowerDraw     *float64 // watts
+	DriverVersion string
+	Updated       time.Time
+}
+
+func queryTelemetry(ctx context.Context, smi NvidiaSmi) ([]GpuTelemetry, error) {
+	out, err := smi(ctx,
+		"--query-gpu="+strings.Join(telemetryFields, ","),
+		"--format=csv,noheader,nounits",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return parseTelemetry(out, time.Now())
+}
+
+func parseTelemetry(out []byte, now time.Time) ([]GpuTelemetry, error) {
+	reader := csv.NewReader(bytes.NewReader(out))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = len(telemetryFields)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected nvidia-smi output: %v", err)
+	}
+
+	result := make([]GpuTelemetry, 0, len(records))
+	for _, record := range records {
+		index, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected GPU index %q in nvidia-smi output", record[0])
+		}
+		t := GpuTelemetry{
+			Index:         index,
+			Name:          record[1],
+			Uuid:          record[2],
+			DriverVersion: record[8],
+			Updated:       now,
+		}
+		if v, err := strconv.ParseInt(record[3], 10, 64); err == nil {
+			t.MemoryUsed = &v
+		}
+		if v, err := strconv.ParseInt(record[4], 10, 64); err == nil {
+			t.MemoryTotal = &v
+		}
+		if v, err := strconv.Atoi(record[5]); err == nil {
+			t.Utilization = &v
+		}
+		if v, err := strconv.Atoi(record[6]); err == nil {
+			t.Temperature = &v
+		}
+		// "[N/A]" or "[Not Supported]" leave the value unset
+		if v, err := strconv.ParseFloat(record[7], 64); err == nil {
+			t.PowerDraw = &v
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// telemetryLoop updates the telemetry until the context is cancelled. Only
+// changes between failing and working queries are logged.
+func (c *InfoCache) telemetryLoop(interval time.Duration) {
+	if interval <= 0 || c.Snapshot().NumGpus == 0 {
+		return
+	}
+	failing := false
+	for {
+		telemetry, err := queryTelemetry(c.ctx, c.smi)
+		if err != nil && c.ctx.Err() == nil {
+			if !failing {
+				log.Error("Error querying GPU telemetry: ", err)
+			}
+			failing = true
+		} else if err == nil {
+			if failing {
+				log.Info("GPU telemetry is available again")
+			}
+			failing = false
+			c.update(func(s *InfoSnapshot) {
+				s.Telemetry = telemetry
+			})
+		}
+		if !plugins.Sleep(c.ctx, interval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"vastai-helper/src/dockerapi"
+)
+
+// fakeNvidiaSmi writes a script printing the GPU list for -L and the csv
+// file for queries, which setTelemetry replaces.
+func fakeNvidiaSmi(t *testing.T) (path string, setTelemetry func(csv string)) {
+	dir := t.TempDir()
+	path = dir + "/nvidia-smi"
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = -L ]; then\n" +
+		"  echo 'GPU 0: NVIDIA GeForce RTX 3090 (UUID: GPU-0)'\n" +
+		"  echo 'GPU 1: NVIDIA GeForce RTX 3090 (UUID: GPU-1)'\n" +
+		"else\n" +
+		"  cat " + dir + "/telemetry.csv\n" +
+		"fi\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path, func(csv string) {
+		if err := ioutil.WriteFile(dir+"/telemetry.tmp", []byte(csv), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(dir+"/telemetry.tmp", dir+"/telemetry.csv"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func waitForSnapshot(t *testing.T, cache *InfoCache, what string, cond func(s *InfoSnapshot) bool) *InfoSnapshot {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if s := cache.Snapshot(); cond(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTelemetryCollection(t *testing.T) {
+	path, setTelemetry := fakeNvidiaSmi(t)
+	setTelemetry("0, NVIDIA GeForce RTX 3090, GPU-0, 1024, 24576, 35, 60, 120.50, 470.57.02\n" +
+		"1, NVIDIA GeForce RTX 3090, GPU-1, [N/A], 24576, [Not Supported], 55, [N/A], 470.57.02\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := newInfoCache(ctx, dockerapi.NewFake(), execNvidiaSmi(path))
+	if n := cache.Snapshot().NumGpus; n != 2 {
+		t.Fatalf("%d GPUs, want 2", n)
+	}
+	done := make(chan struct{})
+	go func() {
+		cache.telemetryLoop(20 * time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	s := waitForSnapshot(t, cache, "telemetry", func(s *InfoSnapshot) bool {
+		return s.Gpus[0].Telemetry != nil
+	})
+	gpu0, gpu1 := s.Gpus[0].Telemetry, s.Gpus[1].Telemetry
+	if gpu0.Uuid != "GPU-0" || *gpu0.MemoryUsed != 1024 || *gpu0.Utilization != 35 ||
+		*gpu0.Temperature != 60 || *gpu0.PowerDraw != 120.5 || gpu0.DriverVersion != "470.57.02" {
+		t.Errorf("unexpected telemetry %+v", gpu0)
+	}
+	if gpu1 == nil || gpu1.MemoryUsed != nil || gpu1.Utilization != nil || gpu1.PowerDraw != nil || *gpu1.MemoryTotal != 24576 {
+		t.Errorf("unsupported values not null: %+v", gpu1)
+	}
+	generation := s.Generation
+
+	// polls measuring the same values are not changes
+	updated := gpu0.Updated
+	waitForSnapshot(t, cache, "next poll", func(s *InfoSnapshot) bool {
+		return s.Gpus[0].Telemetry.Updated.After(updated)
+	})
+	if s := cache.Snapshot(); s.Generation != generation {
+		t.Errorf("generation %d after polling the same values, want %d", s.Generation, generation)
+	}
+
+	setTelemetry("0, NVIDIA GeForce RTX 3090, GPU-0, 1024, 24576, 35, 61, 120.50, 470.57.02\n" +
+		"1, NVIDIA GeForce RTX 3090, GPU-1, [N/A], 24576, [Not Supported], 55, [N/A], 470.57.02\n")
+	s = waitForSnapshot(t, cache, "changed telemetry", func(s *InfoSnapshot) bool {
+		return *s.Gpus[0].Telemetry.Temperature == 61
+	})
+	if s.Generation != generation+1 {
+		t.Errorf("generation %d, want %d", s.Generation, generation+1)
+	}
+	diffs, _, _ := cache.feed.since(generation)
+	if len(diffs) != 1 || len(diffs[0].Gpus) != 1 || diffs[0].Gpus[0].Index != 0 {
+		t.Errorf("unexpected diffs %+v", diffs)
+	}
+}
@@ -6,16 +6,19 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/docker/go-units"
 	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/metrics"
 )
 
 type ContainerIps struct {
@@ -24,6 +27,7 @@ type ContainerIps struct {
 
 type ContainerInfo struct {
 	Status      string // created / restarting / running / removing / paused / exited / dead
+	Health      string // starting / healthy / unhealthy, empty if there is no health check
 	Name        string
 	Image       string
 	Command     string
@@ -40,30 +44,82 @@ type ContainerInfo struct {
 
 	id string // internal
 }
-type InfoCache struct {
+
+var (
+	containerStatuses = []string{"created", "restarting", "running", "removing", "paused", "exited", "dead"}
+	gpuStatuses       = []string{"idle", "mining", "busy"}
+
+	containersGauge = metrics.NewGaugeVec(
+		"containers",
+		"Containers shown by the info API, by status.",
+		"status",
+	)
+	gpusGauge = metrics.NewGaugeVec(
+		"gpus",
+		"GPUs by status.",
+		"status",
+	)
+)
+
+// GpuInfo is returned by /v1/gpus.
+type GpuInfo struct {
+	Index     int
+	Status    string        // idle / mining / busy
+	Container string        `json:",omitempty"` // name of the container using it, not shown for mining
+	Telemetry *GpuTelemetry `json:",omitempty"` // null until queried
+}
+
+// InfoSnapshot is the state of the host at one point in time. Snapshots are
+// never modified once published, so readers need no locking.
+type InfoSnapshot struct {
 	HostName   string
 	NumGpus    int
 	GpuStatus  []string // idle / mining / busy
+	Telemetry  []GpuTelemetry
 	Containers []ContainerInfo
 
-	ctx        context.Context
-	cli        *client.Client
-	cachedJson []byte
+	Gpus       []GpuInfo `json:"-"`
+	Generation uint64    `json:"-"` // incremented by each update with a Diff
+	json       []byte
+}
+
+// InfoCache keeps the current snapshot. Updates build a new snapshot from
+// the current one and swap it in atomically.
+type InfoCache struct {
+	ctx      context.Context
+	cli      dockerapi.Client
+	smi      NvidiaSmi
+	snapshot atomic.Value // *InfoSnapshot
+	feed     *changeFeed
+	epoch    string     // tells generations of different processes apart
+	mu       sync.Mutex // serializes updates
 }
 
-func newInfoCache(ctx context.Context, cli *client.Client) *InfoCache {
+func newInfoCache(ctx context.Context, cli dockerapi.Client, smi NvidiaSmi) *InfoCache {
 	hostName, _ := os.Hostname()
-	return &InfoCache{
-		HostName: hostName,
-		NumGpus:  getNumGpus(),
-		ctx:      ctx,
-		cli:      cli,
+	c := &InfoCache{
+		ctx:   ctx,
+		cli:   cli,
+		smi:   smi,
+		feed:  newChangeFeed(*eventBufferSize),
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
 	}
+	c.publish(&InfoSnapshot{
+		HostName:   hostName,
+		NumGpus:    getNumGpus(ctx, smi),
+		Telemetry:  []GpuTelemetry{},
+		Containers: []ContainerInfo{},
+	})
+	return c
+}
+
+// Snapshot returns the current snapshot, which must not be modified.
+func (c *InfoCache) Snapshot() *InfoSnapshot {
+	return c.snapshot.Load().(*InfoSnapshot)
 }
 
-func getNumGpus() int {
-	cmd := exec.Command("nvidia-smi", "-L")
-	out, err := cmd.Output()
+func getNumGpus(ctx context.Context, smi NvidiaSmi) int {
+	out, err := smi(ctx, "-L")
 	if err != nil {
 		log.Error(err)
 		return 0
@@ -71,8 +127,8 @@ func getNumGpus() int {
 	return strings.Count(string(out), "\n")
 }
 
-func (c *InfoCache) getContainerInfo(cid string) (ContainerInfo, error) {
-	ctJson, err := c.cli.ContainerInspect(c.ctx, cid)
+func (c *InfoCache) getContainerInfo(ctx context.Context, cid string) (ContainerInfo, error) {
+	ctJson, err := c.cli.ContainerInspect(ctx, cid)
 	if err != nil {
 		return ContainerInfo{}, err
 	}
@@ -88,7 +144,10 @@ func (c *InfoCache) getContainerInfo(cid string) (ContainerInfo, error) {
 		Gpus:    []int{},
 		Status:  ctJson.State.Status,
 	}
-	if !shouldCacheContainerInfo(name, inst.Image) {
+	if ctJson.State.Health != nil {
+		inst.Health = ctJson.State.Health.Status
+	}
+	if !shouldCacheContainerInfo(name, inst.Image, inst.Labels) {
 		return ContainerInfo{}, fmt.Errorf("container %s (%s) should not be cached", name, inst.Image)
 	}
 
@@ -138,87 +197,174 @@ func (c *InfoCache) getContainerInfo(cid string) (ContainerInfo, error) {
 	return inst, nil
 }
 
-func (c *InfoCache) updateContainerInfo(cids []string) error {
+// updateContainerInfo inspects the containers and publishes a snapshot with
+// their new info. Containers inspected before an error are still updated.
+func (c *InfoCache) updateContainerInfo(ctx context.Context, cids []string) error {
+	updated := make(map[string]ContainerInfo)
+	var err error
 	for _, cid := range cids {
-		newInst, err := c.getContainerInfo(cid)
+		var inst ContainerInfo
+		inst, err = c.getContainerInfo(ctx, cid)
 		if err != nil {
-			return err
+			break
 		}
-		c._deleteContainerInfo(cid)
-		c.Containers = append(c.Containers, newInst)
+		updated[cid] = inst
 	}
-	c.afterUpdate()
-	return nil
+	if len(updated) > 0 {
+		c.update(func(s *InfoSnapshot) {
+			result := make([]ContainerInfo, 0, len(s.Containers)+len(updated))
+			for _, inst := range s.Containers {
+				if _, ok := updated[inst.id]; !ok {
+					result = append(result, inst)
+				}
+			}
+			for _, inst := range updated {
+				result = append(result, inst)
+			}
+			s.Containers = result
+		})
+	}
+	return err
 }
 
 func (c *InfoCache) deleteContainerInfo(cid string) error {
-	c._deleteContainerInfo(cid)
-	c.afterUpdate()
+	c.update(func(s *InfoSnapshot) {
+		result := make([]ContainerInfo, 0, len(s.Containers))
+		for _, inst := range s.Containers {
+			if inst.id != cid {
+				result = append(result, inst)
+			}
+		}
+		s.Containers = result
+	})
 	return nil
 }
 
-func (c *InfoCache) _deleteContainerInfo(cid string) {
-	result := make([]ContainerInfo, 0, len(c.Containers))
-	for _, inst := range c.Containers {
-		if inst.id != cid {
-			result = append(result, inst)
-		}
+// update publishes a snapshot changed by change, which gets a copy of the
+// current one. Containers can be modified in place (publish sorts them),
+// other slices are shared with the current snapshot and must be replaced.
+func (c *InfoCache) update(change func(*InfoSnapshot)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.Snapshot()
+	s := &InfoSnapshot{
+		HostName:   old.HostName,
+		NumGpus:    old.NumGpus,
+		Telemetry:  old.Telemetry,
+		Containers: append([]ContainerInfo{}, old.Containers...),
+		Generation: old.Generation + 1,
+	}
+	change(s)
+	s.complete()
+	d := diffSnapshots(old, s)
+	if d.empty() {
+		// nothing new for /v1/events clients
+		s.Generation = old.Generation
+	}
+	c.snapshot.Store(s)
+	if !d.empty() {
+		c.feed.add(d)
 	}
-	c.Containers = result
 }
 
-func (c *InfoCache) afterUpdate() {
-	// fill GpuStatus
-	c.GpuStatus = make([]string, c.NumGpus)
-	for i := 0; i < c.NumGpus; i++ {
-		c.GpuStatus[i] = "idle"
+// publish makes the snapshot current.
+func (c *InfoCache) publish(s *InfoSnapshot) {
+	s.complete()
+	c.snapshot.Store(s)
+}
+
+// complete fills in the derived fields of the snapshot.
+func (s *InfoSnapshot) complete() {
+	// fill Gpus and GpuStatus
+	s.Gpus = make([]GpuInfo, s.NumGpus)
+	for i := 0; i < s.NumGpus; i++ {
+		s.Gpus[i] = GpuInfo{Index: i, Status: "idle"}
 	}
-	for _, inst := range c.Containers {
+	for _, inst := range s.Containers {
 		if inst.Status == "running" {
 			for _, i := range inst.Gpus {
+				if i < 0 || i >= s.NumGpus {
+					continue
+				}
 				if inst.isMiningImage() {
-					c.GpuStatus[i] = "mining"
+					s.Gpus[i].Status = "mining"
 				} else {
-					c.GpuStatus[i] = "busy"
+					s.Gpus[i].Status = "busy"
+					s.Gpus[i].Container = inst.Name
 				}
 			}
 		}
 	}
+	s.GpuStatus = make([]string, s.NumGpus)
+	for i, gpu := range s.Gpus {
+		s.GpuStatus[i] = gpu.Status
+	}
+	for i := range s.Telemetry {
+		if t := &s.Telemetry[i]; t.Index >= 0 && t.Index < s.NumGpus {
+			s.Gpus[t.Index].Telemetry = t
+		}
+	}
 
 	// sort: running first, newest first
-	sort.Slice(c.Containers, func(i, j int) bool {
-		st1 := c.Containers[i].statusOrder()
-		st2 := c.Containers[j].statusOrder()
+	sort.Slice(s.Containers, func(i, j int) bool {
+		st1 := s.Containers[i].statusOrder()
+		st2 := s.Containers[j].statusOrder()
 		if st1 < st2 {
 			return true
 		}
 		if st1 > st2 {
 			return false
 		}
-		return c.Containers[i].Created.After(c.Containers[j].Created)
+		return s.Containers[i].Created.After(s.Containers[j].Created)
 	})
 
-	// cache json
-	c.cachedJson = c.generateJson()
+	s.updateMetrics()
+	s.json = s.generateJson()
+}
+
+func (s *InfoSnapshot) updateMetrics() {
+	containers := make(map[string]int)
+	for _, inst := range s.Containers {
+		containers[inst.Status]++
+	}
+	for _, status := range containerStatuses {
+		containersGauge.With(status).Set(float64(containers[status]))
+	}
+	gpus := make(map[string]int)
+	for _, status := range s.GpuStatus {
+		gpus[status]++
+	}
+	for _, status := range gpuStatuses {
+		gpusGauge.With(status).Set(float64(gpus[status]))
+	}
 }
 
-func (c *InfoCache) json() []byte {
-	return c.cachedJson
+// JSON returns the snapshot as served by /info.
+func (s *InfoSnapshot) JSON() []byte {
+	return s.json
 }
 
-func (c *InfoCache) generateJson() []byte {
+// exposed returns the part of the snapshot shown by /info.
+func (s *InfoSnapshot) exposed() *InfoSnapshot {
 	// filter out mining containers
 	exposed := []ContainerInfo{}
-	for _, inst := range c.Containers {
+	for _, inst := range s.Containers {
 		if inst.shouldExpose() {
 			exposed = append(exposed, inst)
 		}
 	}
-	t := *c
-	t.Containers = exposed
+	return &InfoSnapshot{
+		HostName:   s.HostName,
+		NumGpus:    s.NumGpus,
+		GpuStatus:  s.GpuStatus,
+		Telemetry:  s.Telemetry,
+		Containers: exposed,
+		Generation: s.Generation,
+	}
+}
 
-	var err error
-	result, err := json.MarshalIndent(t, "", "    ")
+func (s *InfoSnapshot) generateJson() []byte {
+	result, err := json.MarshalIndent(s.exposed(), "", "    ")
 	if err != nil {
 		log.Error(err)
 		result = []byte("{}")
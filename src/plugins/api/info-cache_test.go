@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/rules"
+)
+
+func TestMain(m *testing.M) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		panic(err)
+	}
+	if err := rules.Load(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeSmi answers "nvidia-smi -L" with the given number of GPUs.
+func fakeSmi(gpus int) NvidiaSmi {
+	return func(ctx context.Context, args ...string) ([]byte, error) {
+		out := ""
+		for i := 0; i < gpus; i++ {
+			out += "GPU\n"
+		}
+		return []byte(out), nil
+	}
+}
+
+func addGpuContainer(cli *dockerapi.Fake, id string, name string, image string, gpus string) {
+	ct := dockerapi.FakeContainer(id, name, image, nil)
+	ct.Config.Env = []string{"NVIDIA_VISIBLE_DEVICES=" + gpus, "CUDA_VERSION=11.2"}
+	cli.AddContainer(ct)
+}
+
+func TestInfoCacheUpdates(t *testing.T) {
+	ctx := context.Background()
+	cli := dockerapi.NewFake()
+	addGpuContainer(cli, "c1", "C.1", "pytorch", "2,0")
+	addGpuContainer(cli, "c2", "C.2", "sergeycheperis/docker-ethminer", "1")
+	addGpuContainer(cli, "c3", "other", "pytorch", "3")
+	cache := newInfoCache(ctx, cli, fakeSmi(4))
+
+	if err := cache.updateContainerInfo(ctx, []string{"c1", "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	s := cache.Snapshot()
+	if s.NumGpus != 4 || len(s.Containers) != 2 || s.Generation != 1 {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+	if c := s.findContainer("C.1"); c == nil || c.CudaVersion != "11.2" || len(c.Gpus) != 2 || c.Gpus[0] != 0 {
+		t.Errorf("unexpected container info %+v", c)
+	}
+	if s.findContainer("C.2") != nil {
+		t.Error("mining container is exposed")
+	}
+	for i, status := range s.GpuStatus {
+		if status != "idle" {
+			t.Errorf("GPU %d is %s before the containers run", i, status)
+		}
+	}
+
+	// containers not matching --api-include are not cached
+	if err := cache.updateContainerInfo(ctx, []string{"c3"}); err == nil {
+		t.Error("container not matching the filter was cached")
+	}
+
+	cli.StartContainer("c1")
+	cli.StartContainer("c2")
+	if err := cache.updateContainerInfo(ctx, []string{"c1", "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	s = cache.Snapshot()
+	want := []string{"busy", "mining", "busy", "idle"}
+	for i, status := range s.GpuStatus {
+		if status != want[i] {
+			t.Errorf("GPU %d is %s, want %s", i, status, want[i])
+		}
+	}
+	if s.Gpus[0].Container != "C.1" || s.Gpus[1].Container != "" {
+		t.Errorf("unexpected GPU containers %+v", s.Gpus)
+	}
+	diffs, _, ok := cache.feed.since(1)
+	if !ok || len(diffs) != 1 || len(diffs[0].Containers) != 1 || len(diffs[0].Gpus) != 3 {
+		t.Errorf("unexpected diffs %+v", diffs)
+	}
+
+	// running containers are listed first
+	addGpuContainer(cli, "c4", "C.4", "pytorch", "3")
+	if err := cache.updateContainerInfo(ctx, []string{"c4"}); err != nil {
+		t.Fatal(err)
+	}
+	if s := cache.Snapshot(); s.Containers[len(s.Containers)-1].Name != "C.4" {
+		t.Errorf("created container is not last: %+v", s.Containers)
+	}
+
+	cache.deleteContainerInfo("c1")
+	s = cache.Snapshot()
+	if s.findContainer("C.1") != nil || s.GpuStatus[0] != "idle" {
+		t.Errorf("deleted container still shown: %+v", s)
+	}
+	diffs, _, _ = cache.feed.since(s.Generation - 1)
+	if len(diffs) != 1 || len(diffs[0].Removed) != 1 || diffs[0].Removed[0] != "C.1" {
+		t.Errorf("unexpected diffs %+v", diffs)
+	}
+}
@@ -2,97 +2,366 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
-	"strings"
+	"sync"
+	"time"
 
-	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/metrics"
+	"vastai-helper/src/plugins"
+	"vastai-helper/src/rules"
 )
 
+const pluginName = "api"
+
+func init() {
+	plugins.Register(pluginName, "Serves host, GPU and container information over HTTP.",
+		func(ctx context.Context, cli dockerapi.Client, stateDir string) plugins.Plugin {
+			return NewPlugin(ctx, cli)
+		})
+}
+
 var (
-	webServerBind = kingpin.Flag(
+	webServerBind = plugins.Flag(pluginName,
 		"web-server-bind",
 		"Web server listen address and/or port.",
 	).Default(":9014").String()
+	cacheFilter = rules.NewFilter(
+		plugins.Flag(pluginName,
+			"api-include",
+			"Only show containers matching the rule (repeatable). Vast.ai containers by default.",
+		),
+		plugins.Flag(pluginName,
+			"api-exclude",
+			"Do not show containers matching the rule (repeatable).",
+		),
+	).DefaultInclude("name=C.*")
 )
 
 type ApiPlugin struct {
+	plugins.Base
 	ctx                  context.Context
-	cli                  *client.Client
+	cli                  dockerapi.Client
 	cache                *InfoCache
 	discoveredContainers []string
+	settings             ServerSettings
+	mu                   sync.Mutex // guards discoveredContainers and settings
+	mux                  *http.ServeMux
+	server               *http.Server
+	healthServer         *http.Server
 }
 
-func NewPlugin(ctx context.Context, cli *client.Client) *ApiPlugin {
+func NewPlugin(ctx context.Context, cli dockerapi.Client) *ApiPlugin {
 	return &ApiPlugin{
 		ctx:   ctx,
 		cli:   cli,
-		cache: newInfoCache(ctx, cli),
+		cache: newInfoCache(ctx, cli, execNvidiaSmi(*nvidiaSmiPath)),
 	}
 }
 
-func (p *ApiPlugin) ContainerDiscovered(cid string, cname string, image string) error {
-	if shouldCacheContainerInfo(cname, image) {
-		p.discoveredContainers = append(p.discoveredContainers, cid)
+func (p *ApiPlugin) ContainerDiscovered(ctx context.Context, event *plugins.Event) error {
+	if shouldCacheContainerInfo(event.ContainerName, event.Image, event.Labels) {
+		p.mu.Lock()
+		p.discoveredContainers = append(p.discoveredContainers, event.ContainerId)
+		p.mu.Unlock()
 	}
 	return nil
 }
 
 func (p *ApiPlugin) Start() error {
-	err := p.cache.updateContainerInfo(p.discoveredContainers)
+	settings, err := currentSettings()
 	if err != nil {
 		return err
 	}
+	p.settings = settings
 
-	go func() {
-		http.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(p.cache.json())
+	err = p.cache.updateContainerInfo(p.ctx, p.discoveredContainers)
+	if err != nil {
+		return err
+	}
+
+	p.mux = http.NewServeMux()
+	p.mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(p.cache.Snapshot().JSON())
+	})
+	p.addRestHandlers(p.mux)
+	p.mux.Handle("/metrics", metrics.Handler())
+	p.mux.HandleFunc("/healthz", serveHealth(false))
+	p.mux.HandleFunc("/readyz", serveHealth(true))
+	tlsConfig, err := newTlsConfig(&settings)
+	if err != nil {
+		return err
+	}
+	// servers which cannot listen are started again on reload
+	if ln, err := listen(settings.bind); err != nil {
+		log.WithFields(log.Fields{"bind": settings.bind}).Error(err)
+	} else {
+		p.startServer(&settings, tlsConfig, ln)
+	}
+	if settings.healthBind != "" {
+		if ln, err := listen(settings.healthBind); err != nil {
+			log.WithFields(log.Fields{"bind": settings.healthBind}).Error(err)
+		} else {
+			p.startHealthServer(settings.healthBind, ln)
+		}
+	}
+	go plugins.Supervise(p.ctx, pluginName, func() {
+		p.cache.telemetryLoop(*telemetryInterval)
+	})
+
+	return nil
+}
+
+// serveHealth reports the results of the health checks, with status 503 if
+// any of them failed.
+func serveHealth(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks, healthy := plugins.RunHealthChecks(readiness)
+		status := "ok"
+		if !healthy {
+			status = "degraded"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		plugins.WriteJson(w, map[string]interface{}{
+			"status": status,
+			"checks": checks,
 		})
-		logger := log.WithFields(log.Fields{"bind": *webServerBind})
+	}
+}
+
+// listen binds the address before a server is started or replaced, so that
+// the running server is kept if it is not available.
+func listen(addr string) (net.Listener, error) {
+	if addr == "" {
+		addr = ":http"
+	}
+	return net.Listen("tcp", addr)
+}
+
+// startServer serves plain HTTP if tlsConfig is nil.
+func (p *ApiPlugin) startServer(settings *ServerSettings, tlsConfig *tls.Config, ln net.Listener) {
+	// event streams only end when their requests are cancelled
+	ctx, cancel := context.WithCancel(p.ctx)
+	server := &http.Server{
+		Addr:        settings.bind,
+		Handler:     p.authenticate(p.mux),
+		TLSConfig:   tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	server.RegisterOnShutdown(cancel)
+	p.server = server
+
+	go func() {
+		logger := log.WithFields(log.Fields{"bind": server.Addr, "tls": server.TLSConfig != nil})
 		logger.Info("Starting web server")
-		if err := http.ListenAndServe(*webServerBind, nil); err != nil {
+		var err error
+		if server.TLSConfig != nil {
+			// the certificate comes from TLSConfig.GetCertificate
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
 			logger.Error(err)
 		}
 	}()
+}
 
-	return nil
+// startHealthServer serves the health checks for load balancers and
+// orchestrators which cannot authenticate.
+func (p *ApiPlugin) startHealthServer(bind string, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealth(false))
+	mux.HandleFunc("/readyz", serveHealth(true))
+	server := &http.Server{Addr: bind, Handler: mux}
+	p.healthServer = server
+
+	go func() {
+		logger := log.WithFields(log.Fields{"bind": server.Addr})
+		logger.Info("Starting health check server")
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			logger.Error(err)
+		}
+	}()
 }
 
-func (p *ApiPlugin) ContainerCreated(cid string, cname string, image string) error {
-	if shouldCacheContainerInfo(cname, image) {
-		return p.cache.updateContainerInfo([]string{cid})
+// Reload applies new tokens and the event buffer size right away. The
+// servers are replaced once the new address is bound, a server which could
+// not be replaced keeps running with its previous settings, which are tried
+// again on the next reload.
+func (p *ApiPlugin) Reload() error {
+	p.cache.feed.setSize(*eventBufferSize)
+	if p.mux == nil {
+		return nil
 	}
-	return nil
+	settings, err := currentSettings()
+	if err != nil {
+		return err
+	}
+	old := p.getSettings()
+
+	ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
+	defer cancel()
+	healthErr := p.reloadHealthServer(ctx, &settings)
+	if healthErr != nil {
+		settings.healthBind = old.healthBind
+	}
+	serverErr := p.reloadServer(ctx, &settings, &old)
+	if serverErr != nil {
+		settings.bind = old.bind
+		settings.certFile = old.certFile
+		settings.keyFile = old.keyFile
+		settings.clientCa = old.clientCa
+	}
+	p.mu.Lock()
+	p.settings = settings
+	p.mu.Unlock()
+	if healthErr != nil {
+		return healthErr
+	}
+	return serverErr
 }
 
-func (p *ApiPlugin) ContainerDestroyed(cid string, cname string, image string) error {
-	if shouldCacheContainerInfo(cname, image) {
-		return p.cache.deleteContainerInfo(cid)
+func (p *ApiPlugin) reloadServer(ctx context.Context, settings *ServerSettings, old *ServerSettings) error {
+	if p.server != nil && settings.sameServer(old) {
+		return nil
+	}
+	tlsConfig, err := newTlsConfig(settings)
+	if err != nil {
+		return err
+	}
+	if p.server != nil && settings.bind == old.bind {
+		// the address is only available once the running server stopped
+		if err := p.stopServer(ctx); err != nil {
+			return err
+		}
+	}
+	ln, err := listen(settings.bind)
+	if err != nil {
+		return err
+	}
+	if p.server != nil {
+		if err := p.stopServer(ctx); err != nil {
+			ln.Close()
+			return err
+		}
 	}
+	p.startServer(settings, tlsConfig, ln)
 	return nil
 }
 
-func (p *ApiPlugin) ContainerStarted(cid string, cname string, image string) error {
-	if shouldCacheContainerInfo(cname, image) {
-		return p.cache.updateContainerInfo([]string{cid})
+func (p *ApiPlugin) stopServer(ctx context.Context) error {
+	log.WithFields(log.Fields{"bind": p.server.Addr}).Info("Stopping web server")
+	err := p.server.Shutdown(ctx)
+	p.server = nil
+	return err
+}
+
+func (p *ApiPlugin) reloadHealthServer(ctx context.Context, settings *ServerSettings) error {
+	bind := ""
+	if p.healthServer != nil {
+		bind = p.healthServer.Addr
+	}
+	if settings.healthBind == bind {
+		return nil
+	}
+	var ln net.Listener
+	if settings.healthBind != "" {
+		var err error
+		if ln, err = listen(settings.healthBind); err != nil {
+			return err
+		}
+	}
+	if p.healthServer != nil {
+		log.WithFields(log.Fields{"bind": p.healthServer.Addr}).Info("Stopping health check server")
+		err := p.healthServer.Shutdown(ctx)
+		p.healthServer = nil
+		if err != nil {
+			if ln != nil {
+				ln.Close()
+			}
+			return err
+		}
+	}
+	if ln != nil {
+		p.startHealthServer(settings.healthBind, ln)
 	}
 	return nil
 }
 
-func (p *ApiPlugin) ContainerStopped(cid string, cname string, image string) error {
-	if shouldCacheContainerInfo(cname, image) {
-		return p.cache.updateContainerInfo([]string{cid})
+func (p *ApiPlugin) Stop(ctx context.Context) error {
+	if p.healthServer != nil {
+		if err := p.healthServer.Shutdown(ctx); err != nil {
+			log.Error("Error stopping health check server: ", err)
+		}
+	}
+	if p.server == nil {
+		return nil
+	}
+	log.Info("Stopping web server")
+	return p.server.Shutdown(ctx)
+}
+
+func (p *ApiPlugin) ContainerCreated(ctx context.Context, event *plugins.Event) error {
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) ContainerDestroyed(ctx context.Context, event *plugins.Event) error {
+	if shouldCacheContainerInfo(event.ContainerName, event.Image, event.Labels) {
+		return p.cache.deleteContainerInfo(event.ContainerId)
 	}
 	return nil
 }
 
-func (p *ApiPlugin) ImageRemoved(image string) error {
+func (p *ApiPlugin) ContainerStarted(ctx context.Context, event *plugins.Event) error {
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) ContainerStopped(ctx context.Context, event *plugins.Event) error {
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) ContainerPaused(ctx context.Context, event *plugins.Event) error {
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) ContainerUnpaused(ctx context.Context, event *plugins.Event) error {
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) ContainerHealthStatus(ctx context.Context, event *plugins.Event) error {
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) ContainerRenamed(ctx context.Context, event *plugins.Event) error {
+	if !shouldCacheContainerInfo(event.ContainerName, event.Image, event.Labels) &&
+		shouldCacheContainerInfo(event.OldName, event.Image, event.Labels) {
+		return p.cache.deleteContainerInfo(event.ContainerId)
+	}
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) NetworkConnected(ctx context.Context, event *plugins.Event) error {
+	// refresh IP addresses
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) NetworkDisconnected(ctx context.Context, event *plugins.Event) error {
+	return p.updateContainer(ctx, event)
+}
+
+func (p *ApiPlugin) updateContainer(ctx context.Context, event *plugins.Event) error {
+	if shouldCacheContainerInfo(event.ContainerName, event.Image, event.Labels) {
+		return p.cache.updateContainerInfo(ctx, []string{event.ContainerId})
+	}
 	return nil
 }
 
-func shouldCacheContainerInfo(cname string, image string) bool {
-	// vast.ai containers only
-	return strings.HasPrefix(cname, "C.") || strings.HasPrefix(cname, "/C.")
+func shouldCacheContainerInfo(cname string, image string, labels map[string]string) bool {
+	return cacheFilter.Match(rules.Container{Name: cname, Image: image, Labels: labels})
 }
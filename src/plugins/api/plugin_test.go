@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"vastai-helper/src/dockerapi"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func serves(addr string, path string) bool {
+	client := http.Client{Timeout: time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func TestReloadKeepsServerIfAddressInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	addr := freeAddr(t)
+	defer func(bind string, health string) {
+		*webServerBind, *healthBind = bind, health
+	}(*webServerBind, *healthBind)
+	*webServerBind = addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewPlugin(ctx, dockerapi.NewFake())
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop(context.Background())
+	if !serves(addr, "/info") {
+		t.Fatal("server not started")
+	}
+
+	*webServerBind = busy.Addr().String()
+	*healthBind = busy.Addr().String()
+	if err := p.Reload(); err == nil {
+		t.Error("reload to an address in use succeeded")
+	}
+	if !serves(addr, "/info") {
+		t.Error("running server was stopped")
+	}
+	if s := p.getSettings(); s.bind != addr || s.healthBind != "" {
+		t.Errorf("settings of the servers not started were kept: %+v", s)
+	}
+
+	newAddr, healthAddr := freeAddr(t), freeAddr(t)
+	*webServerBind, *healthBind = newAddr, healthAddr
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !serves(newAddr, "/info") || !serves(healthAddr, "/healthz") {
+		t.Error("servers not moved to the new addresses")
+	}
+	if serves(addr, "/info") {
+		t.Error("server still serving on the old address")
+	}
+}
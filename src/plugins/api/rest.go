@@ -0,0 +1,145 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"vastai-helper/src/plugins"
+)
+
+// addRestHandlers serves parts of the /info document:
+//
+//	/v1/containers                containers, filtered by ?status=...&label=k=v
+//	/v1/containers/{name-or-id}   a single container, ids can be abbreviated
+//	/v1/gpus                      GPUs, filtered by ?status=...
+//	/v1/gpus/{index}              a single GPU
+//	/v1/events                    changes, see serveEvents
+//
+// Repeated status filters match any of the values, repeated label filters
+// must all match. A label filter without a value only requires the label.
+func (p *ApiPlugin) addRestHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/containers", p.serveContainers)
+	mux.HandleFunc("/v1/containers/", p.serveContainer)
+	mux.HandleFunc("/v1/gpus", p.serveGpus)
+	mux.HandleFunc("/v1/gpus/", p.serveGpu)
+	mux.HandleFunc("/v1/events", p.serveEvents)
+}
+
+func (p *ApiPlugin) serveContainers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkStatuses(query, containerStatuses); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := []ContainerInfo{}
+	for _, inst := range p.cache.Snapshot().Containers {
+		if inst.shouldExpose() && inst.matches(query) {
+			result = append(result, inst)
+		}
+	}
+	plugins.WriteJson(w, result)
+}
+
+func (p *ApiPlugin) serveContainer(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/v1/containers/")
+	if inst := p.cache.Snapshot().findContainer(ref); inst != nil {
+		plugins.WriteJson(w, inst)
+		return
+	}
+	http.Error(w, fmt.Sprintf("no such container: %s", ref), http.StatusNotFound)
+}
+
+func (p *ApiPlugin) serveGpus(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkStatuses(query, gpuStatuses); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := []GpuInfo{}
+	for _, gpu := range p.cache.Snapshot().Gpus {
+		if matchesStatus(query, gpu.Status) {
+			result = append(result, gpu)
+		}
+	}
+	plugins.WriteJson(w, result)
+}
+
+func (p *ApiPlugin) serveGpu(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/v1/gpus/")
+	gpus := p.cache.Snapshot().Gpus
+	if i, err := strconv.Atoi(ref); err == nil && i >= 0 && i < len(gpus) {
+		plugins.WriteJson(w, gpus[i])
+		return
+	}
+	http.Error(w, fmt.Sprintf("no such gpu: %s", ref), http.StatusNotFound)
+}
+
+// findContainer looks up an exposed container by name, id or unique id
+// prefix, in this order.
+func (s *InfoSnapshot) findContainer(ref string) *ContainerInfo {
+	if ref == "" {
+		return nil
+	}
+	var byPrefix *ContainerInfo
+	prefixMatches := 0
+	for i := range s.Containers {
+		inst := &s.Containers[i]
+		if !inst.shouldExpose() {
+			continue
+		}
+		if inst.Name == ref || inst.id == ref {
+			return inst
+		}
+		if strings.HasPrefix(inst.id, ref) {
+			byPrefix = inst
+			prefixMatches++
+		}
+	}
+	if prefixMatches == 1 {
+		return byPrefix
+	}
+	return nil
+}
+
+func (c *ContainerInfo) matches(query url.Values) bool {
+	if !matchesStatus(query, c.Status) {
+		return false
+	}
+	for _, filter := range query["label"] {
+		parts := strings.SplitN(filter, "=", 2)
+		value, ok := c.Labels[parts[0]]
+		if !ok || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesStatus(query url.Values, status string) bool {
+	statuses := query["status"]
+	if len(statuses) == 0 {
+		return true
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func checkStatuses(query url.Values, known []string) error {
+	for _, s := range query["status"] {
+		found := false
+		for _, k := range known {
+			found = found || s == k
+		}
+		if !found {
+			return fmt.Errorf("unknown status %q, expected one of %s", s, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
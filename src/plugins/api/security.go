@@ -0,0 +1,199 @@
+package api
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/config"
+	"vastai-helper/src/plugins"
+)
+
+var (
+	tlsCert = plugins.Flag(pluginName,
+		"api-tls-cert",
+		"Certificate file, serve HTTPS instead of HTTP. It is reloaded when it changes.",
+	).PlaceHolder("FILE").String()
+	tlsKey = plugins.Flag(pluginName,
+		"api-tls-key",
+		"Private key file of --api-tls-cert.",
+	).PlaceHolder("FILE").String()
+	clientCa = plugins.Flag(pluginName,
+		"api-client-ca",
+		"Require client certificates signed by the CAs in the file (needs --api-tls-cert).",
+	).PlaceHolder("FILE").String()
+	tokens = config.StringList(plugins.Flag(pluginName,
+		"api-token",
+		"Require \"Authorization: Bearer TOKEN\" on requests (repeatable), the name is logged.",
+	).PlaceHolder("NAME=TOKEN"))
+	healthBind = plugins.Flag(pluginName,
+		"api-health-bind",
+		"Also serve /healthz and /readyz without authentication or TLS on this address.",
+	).String()
+)
+
+// ServerSettings are read on start and reload. Tokens apply to the next
+// request, the other settings restart the affected server when changed.
+type ServerSettings struct {
+	bind       string
+	certFile   string
+	keyFile    string
+	clientCa   string
+	tokens     map[string]string // token -> name
+	healthBind string
+}
+
+func currentSettings() (ServerSettings, error) {
+	s := ServerSettings{
+		bind:       *webServerBind,
+		certFile:   *tlsCert,
+		keyFile:    *tlsKey,
+		clientCa:   *clientCa,
+		tokens:     make(map[string]string),
+		healthBind: *healthBind,
+	}
+	if (s.certFile == "") != (s.keyFile == "") {
+		return s, fmt.Errorf("--api-tls-cert and --api-tls-key must be set together")
+	}
+	if s.clientCa != "" && s.certFile == "" {
+		return s, fmt.Errorf("--api-client-ca requires --api-tls-cert")
+	}
+	for _, value := range *tokens {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return s, fmt.Errorf("Invalid --api-token, expected NAME=TOKEN")
+		}
+		s.tokens[parts[1]] = parts[0]
+	}
+	return s, nil
+}
+
+// sameServer tells whether the web server can keep running with the new
+// settings.
+func (s *ServerSettings) sameServer(other *ServerSettings) bool {
+	return s.bind == other.bind && s.certFile == other.certFile &&
+		s.keyFile == other.keyFile && s.clientCa == other.clientCa
+}
+
+func (p *ApiPlugin) getSettings() ServerSettings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.settings
+}
+
+// authenticate requires one of the tokens, if any are set.
+func (p *ApiPlugin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens := p.getSettings().tokens
+		if len(tokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			if name := findToken(tokens, strings.TrimPrefix(auth, "Bearer ")); name != "" {
+				log.WithFields(log.Fields{"token": name, "path": r.URL.Path}).Debug("Authenticated request")
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		log.WithFields(log.Fields{"remote": r.RemoteAddr, "path": r.URL.Path}).Debug("Unauthorized request")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vastai-helper"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// findToken returns the name of the token, comparing all of them in
+// constant time.
+func findToken(tokens map[string]string, token string) string {
+	found := ""
+	for t, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = name
+		}
+	}
+	return found
+}
+
+// newTlsConfig returns nil if no certificate is set.
+func newTlsConfig(s *ServerSettings) (*tls.Config, error) {
+	if s.certFile == "" {
+		return nil, nil
+	}
+	certs := &certLoader{certFile: s.certFile, keyFile: s.keyFile}
+	if err := certs.reload(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: certs.get,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if s.clientCa != "" {
+		pem, err := ioutil.ReadFile(s.clientCa)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", s.clientCa)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certLoader reloads the certificate when the modification time of either
+// file changes, so that renewed certificates are used without a restart.
+// While a renewal is half written, the previous certificate is kept.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time // of the files last tried
+}
+
+func (l *certLoader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reload(); err != nil {
+		log.WithFields(log.Fields{"cert": l.certFile, "key": l.keyFile}).Error("Error reloading TLS certificate: ", err)
+		if l.cert == nil {
+			return nil, err
+		}
+	}
+	return l.cert, nil
+}
+
+func (l *certLoader) reload() error {
+	certInfo, err := os.Stat(l.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(l.keyFile)
+	if err != nil {
+		return err
+	}
+	modTimes := [2]time.Time{certInfo.ModTime(), keyInfo.ModTime()}
+	if modTimes == l.modTimes {
+		return nil
+	}
+	l.modTimes = modTimes
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	log.WithFields(log.Fields{"cert": l.certFile}).Info("Loaded TLS certificate")
+	return nil
+}
@@ -6,53 +6,256 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/journal"
+	"vastai-helper/src/metrics"
+	"vastai-helper/src/plugins"
+	"vastai-helper/src/rules"
+	"vastai-helper/src/statedir"
+)
+
+var (
+	pruneRuns = metrics.NewCounter(
+		"prune_runs_total",
+		"Auto-prune runs.",
+	)
+	pruneRemoved = metrics.NewCounterVec(
+		"prune_removed_total",
+		"Objects removed by auto-prune, by kind.",
+		"kind",
+	)
+	pruneReclaimed = metrics.NewCounterVec(
+		"prune_reclaimed_bytes_total",
+		"Disk space reclaimed by auto-prune, by kind.",
+		"kind",
+	)
 )
 
+// maxFailedRuns is the number of consecutive failed prune runs the health
+// check fails after, single failures are often transient.
+const maxFailedRuns = 3
+
 type PruneSettings struct {
 	expireTime            time.Duration
 	taggedImageExpireTime time.Duration
 	pruneInterval         time.Duration
 }
 
+// PruneResult describes a finished prune run.
+type PruneResult struct {
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Pruned    bool      `json:"pruned"` // false if there was nothing to prune
+	Reclaimed uint64    `json:"reclaimed"`
+	Errors    int       `json:"errors"`
+	Next      time.Time `json:"next"`
+}
+
 type AutoPruner struct {
-	ctx      context.Context
-	cli      *client.Client
-	stateDir string
-	settings PruneSettings
+	ctx        context.Context
+	cli        dockerapi.Client
+	stateDir   string
+	settings   PruneSettings
+	last       *PruneResult
+	failedRuns int        // consecutive runs with errors which pruned nothing
+	mu         sync.Mutex // guards settings, last and failedRuns
+	reloaded   chan struct{}
+	runNow     chan chan PruneResult
+	done       chan struct{}
+	reclaimed  uint64 // in the current run
+	errors     int    // in the current run
 }
 
-func newAutoPruner(ctx context.Context, cli *client.Client, stateDir string, settings PruneSettings) *AutoPruner {
+func newAutoPruner(ctx context.Context, cli dockerapi.Client, stateDir string, settings PruneSettings) *AutoPruner {
 	return &AutoPruner{
 		ctx:      ctx,
 		cli:      cli,
 		stateDir: stateDir,
 		settings: settings,
+		reloaded: make(chan struct{}, 1),
+		runNow:   make(chan chan PruneResult),
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *AutoPruner) getSettings() PruneSettings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.settings
+}
+
+func (p *AutoPruner) setSettings(settings PruneSettings) {
+	p.mu.Lock()
+	p.settings = settings
+	p.mu.Unlock()
+	select {
+	case p.reloaded <- struct{}{}:
+	default:
 	}
 }
 
+func (p *AutoPruner) lastResult() *PruneResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// record stores the result of a finished run.
+func (p *AutoPruner) record(result PruneResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = &result
+	if result.Errors > 0 && !result.Pruned {
+		p.failedRuns++
+	} else {
+		p.failedRuns = 0
+	}
+}
+
+// health fails if the last maxFailedRuns prune runs all failed, or if runs
+// stopped.
+func (p *AutoPruner) health() (string, error) {
+	p.mu.Lock()
+	last, failedRuns := p.last, p.failedRuns
+	p.mu.Unlock()
+	if last == nil {
+		return "no prune run yet", nil
+	}
+	if failedRuns >= maxFailedRuns {
+		return "", fmt.Errorf("last %d runs failed, the last at %s had %d errors", failedRuns, last.Finished.Format(time.RFC3339), last.Errors)
+	}
+	if overdue := time.Since(last.Next); overdue > time.Hour {
+		return "", fmt.Errorf("no prune run since %s", last.Finished.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("last run at %s reclaimed %s", last.Finished.Format(time.RFC3339), formatSpace(last.Reclaimed)), nil
+}
+
+// pruneNow starts a prune run, after the one in progress if any, and returns
+// its result.
+func (p *AutoPruner) pruneNow(ctx context.Context) (PruneResult, error) {
+	reply := make(chan PruneResult, 1)
+	select {
+	case p.runNow <- reply:
+	case <-ctx.Done():
+		return PruneResult{}, ctx.Err()
+	case <-p.done:
+		return PruneResult{}, context.Canceled
+	}
+	select {
+	case result := <-reply:
+		return result, nil
+	case <-ctx.Done():
+		return PruneResult{}, ctx.Err()
+	case <-p.done:
+		return PruneResult{}, context.Canceled
+	}
+}
+
+// start runs the loop until the context is cancelled.
+func (p *AutoPruner) start() {
+	go func() {
+		defer close(p.done)
+		plugins.Supervise(p.ctx, pluginName, p.loop)
+	}()
+}
+
+// loop prunes periodically until the context is cancelled.
 func (p *AutoPruner) loop() {
 	os.MkdirAll(p.stateDir, 0700)
-	time.Sleep(time.Minute)
+	var waiting []chan PruneResult // runs requested with pruneNow
+	select {
+	case <-time.After(time.Minute):
+	case reply := <-p.runNow:
+		waiting = append(waiting, reply)
+	case <-p.ctx.Done():
+		return
+	}
 	for {
+		settings := p.getSettings()
+		started := time.Now()
 		log.WithFields(log.Fields{
-			"expire-time":              p.settings.expireTime,
-			"tagged-image-expire-time": p.settings.taggedImageExpireTime,
-			"interval":                 p.settings.pruneInterval,
+			"expire-time":              settings.expireTime,
+			"tagged-image-expire-time": settings.taggedImageExpireTime,
+			"interval":                 settings.pruneInterval,
 		}).Info("Doing auto-prune")
+		p.reclaimed = 0
+		p.errors = 0
 		ok1 := p.pruneContainers()
 		ok2 := p.pruneImages()
 		ok3 := p.pruneTempImages()
 		ok4 := p.pruneBuildCache()
-		if !ok1 && !ok2 && !ok3 && !ok4 {
+		pruned := ok1 || ok2 || ok3 || ok4
+		if !pruned {
 			log.Info("Nothing to prune")
 		}
-		time.Sleep(p.settings.pruneInterval)
+		pruneRuns.Inc()
+		result := PruneResult{
+			Started:   started,
+			Finished:  time.Now(),
+			Pruned:    pruned,
+			Reclaimed: p.reclaimed,
+			Errors:    p.errors,
+			Next:      time.Now().Add(settings.pruneInterval),
+		}
+		p.record(result)
+		for _, reply := range waiting {
+			reply <- result
+		}
+		waiting = nil
+		if p.reclaimed > 0 {
+			plugins.Notify(plugins.Notice{
+				Kind:   "prune",
+				Plugin: pluginName,
+				Details: map[string]string{
+					"reclaimed": fmt.Sprint(p.reclaimed),
+					"size":      formatSpace(p.reclaimed),
+				},
+			})
+		}
+		reply, ok := p.wait()
+		if !ok {
+			return
+		}
+		if reply != nil {
+			waiting = append(waiting, reply)
+		}
+	}
+}
+
+// wait sleeps for the prune interval, starting over when the settings are
+// changed. It returns early with the reply channel of a pruneNow request, and
+// returns false if the context was cancelled.
+func (p *AutoPruner) wait() (chan PruneResult, bool) {
+	timer := time.NewTimer(p.getSettings().pruneInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil, true
+		case reply := <-p.runNow:
+			return reply, true
+		case <-p.reloaded:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(p.getSettings().pruneInterval)
+			p.mu.Lock()
+			if p.last != nil {
+				last := *p.last
+				last.Next = time.Now().Add(p.settings.pruneInterval)
+				p.last = &last
+			}
+			p.mu.Unlock()
+		case <-p.ctx.Done():
+			return nil, false
+		}
 	}
 }
 
@@ -67,6 +270,7 @@ func (p *AutoPruner) pruneContainers() bool {
 	})
 	if err != nil {
 		log.WithField("err", err).Error("Error listing containers")
+		p.errors++
 		return false
 	}
 
@@ -75,7 +279,7 @@ func (p *AutoPruner) pruneContainers() bool {
 
 	for _, container := range containers {
 		cname := strings.TrimLeft(container.Names[0], "/")
-		if !strings.HasPrefix(cname, "C.") { // skip vast.ai containers
+		if pruneFilter.Match(rules.Container{Name: cname, Image: container.Image, Labels: container.Labels}) {
 			logger := log.WithFields(log.Fields{
 				"cid":   container.ID[:12],
 				"cname": cname,
@@ -94,14 +298,28 @@ func (p *AutoPruner) pruneContainers() bool {
 			}
 
 			age := time.Since(finishTs).Round(time.Second)
-			if age > p.settings.expireTime {
-				err := p.cli.ContainerRemove(p.ctx, info.ID, types.ContainerRemoveOptions{})
-				if err != nil {
-					logger.WithField("err", err).Error("Error removing container")
-				} else {
-					count++
-					size += uint64(container.SizeRw)
-				}
+			if age <= p.getSettings().expireTime {
+				continue
+			}
+			entry := journal.Entry{
+				Cid:     info.ID,
+				Cname:   cname,
+				Image:   info.Config.Image,
+				Details: map[string]string{"age": age.String()},
+			}
+			if plugins.DryRun() {
+				logger.WithFields(log.Fields{"age": age}).Info("Dry run: would remove container")
+				journal.Planned(pluginName, "remove container", entry)
+				continue
+			}
+			err = p.cli.ContainerRemove(p.ctx, info.ID, types.ContainerRemoveOptions{})
+			journal.Action(pluginName, "remove container", entry, err)
+			if err != nil {
+				p.errors++
+				logger.WithField("err", err).Error("Error removing container")
+			} else {
+				count++
+				size += uint64(container.SizeRw)
 			}
 		}
 	}
@@ -111,6 +329,9 @@ func (p *AutoPruner) pruneContainers() bool {
 			"count": count,
 			"size":  formatSpace(size),
 		}).Info("Pruned containers")
+		pruneRemoved.With("containers").Add(float64(count))
+		pruneReclaimed.With("containers").Add(float64(size))
+		p.reclaimed += size
 		return true
 	}
 	return false
@@ -120,6 +341,7 @@ func (p *AutoPruner) pruneImages() bool {
 	images, err := p.cli.ImageList(p.ctx, types.ImageListOptions{})
 	if err != nil {
 		log.WithField("err", err).Error("Error listing images")
+		p.errors++
 		return false
 	}
 
@@ -138,20 +360,39 @@ func (p *AutoPruner) pruneImages() bool {
 			continue
 		}
 		// unused and tagged image
-		if p.isImageExpired(image.ID) {
-			_, err := p.cli.ImageRemove(p.ctx, image.ID, types.ImageRemoveOptions{})
-			if err != nil {
-				log.WithFields(log.Fields{
-					"image": imageIdDisplay(image.ID),
-					"tags":  image.RepoTags,
-					"err":   err,
-				}).Error("Error removing image")
-			} else {
-				count++
-				size += uint64(image.Size)
-				imageIds = append(imageIds, imageIdDisplay(image.ID))
-				tags = append(tags, image.RepoTags...)
-			}
+		if !p.isImageExpired(image.ID) {
+			continue
+		}
+		entry := journal.Entry{
+			Image: image.ID,
+			Details: map[string]string{
+				"tags": strings.Join(image.RepoTags, ","),
+				"size": formatSpace(uint64(image.Size)),
+			},
+		}
+		if plugins.DryRun() {
+			log.WithFields(log.Fields{
+				"image": imageIdDisplay(image.ID),
+				"tags":  image.RepoTags,
+				"size":  formatSpace(uint64(image.Size)),
+			}).Info("Dry run: would remove image")
+			journal.Planned(pluginName, "remove image", entry)
+			continue
+		}
+		_, err := p.cli.ImageRemove(p.ctx, image.ID, types.ImageRemoveOptions{})
+		journal.Action(pluginName, "remove image", entry, err)
+		if err != nil {
+			p.errors++
+			log.WithFields(log.Fields{
+				"image": imageIdDisplay(image.ID),
+				"tags":  image.RepoTags,
+				"err":   err,
+			}).Error("Error removing image")
+		} else {
+			count++
+			size += uint64(image.Size)
+			imageIds = append(imageIds, imageIdDisplay(image.ID))
+			tags = append(tags, image.RepoTags...)
 		}
 	}
 
@@ -162,6 +403,9 @@ func (p *AutoPruner) pruneImages() bool {
 			"tags":   tags,
 			"size":   formatSpace(size),
 		}).Info("Pruned tagged images")
+		pruneRemoved.With("tagged_images").Add(float64(count))
+		pruneReclaimed.With("tagged_images").Add(float64(size))
+		p.reclaimed += size
 		return true
 	}
 	if len(update) > 0 {
@@ -171,12 +415,18 @@ func (p *AutoPruner) pruneImages() bool {
 }
 
 func (p *AutoPruner) pruneTempImages() bool {
+	if plugins.DryRun() {
+		p.planTempImages()
+		return false
+	}
 	report, err := p.cli.ImagesPrune(p.ctx, filters.NewArgs(
-		filters.Arg("until", p.settings.expireTime.String()),
+		filters.Arg("until", p.getSettings().expireTime.String()),
 		filters.Arg("dangling", "true"),
 	))
 	if err != nil {
 		log.WithField("err", err).Error("Error pruning temporary images", err)
+		journal.Action(pluginName, "prune temporary images", journal.Entry{}, err)
+		p.errors++
 	} else if len(report.ImagesDeleted) > 0 {
 		count := 0
 		imageIds := []string{}
@@ -196,23 +446,53 @@ func (p *AutoPruner) pruneTempImages() bool {
 			"tags":   tags,
 			"size":   formatSpace(report.SpaceReclaimed),
 		}).Info("Pruned temporary images")
+		pruneRemoved.With("temporary_images").Add(float64(count))
+		pruneReclaimed.With("temporary_images").Add(float64(report.SpaceReclaimed))
+		p.reclaimed += report.SpaceReclaimed
+		for _, item := range report.ImagesDeleted {
+			if item.Deleted != "" {
+				journal.Action(pluginName, "remove image", journal.Entry{Image: item.Deleted}, nil)
+			}
+		}
+		journal.Action(pluginName, "prune temporary images", journal.Entry{
+			Details: map[string]string{
+				"count": fmt.Sprint(count),
+				"tags":  strings.Join(tags, ","),
+				"size":  formatSpace(report.SpaceReclaimed),
+			},
+		}, nil)
 		return true
 	}
 	return false
 }
 
 func (p *AutoPruner) pruneBuildCache() bool {
+	if plugins.DryRun() {
+		p.planBuildCache()
+		return false
+	}
 	report, err := p.cli.BuildCachePrune(p.ctx, types.BuildCachePruneOptions{
 		All:     true,
-		Filters: filters.NewArgs(filters.Arg("until", p.settings.expireTime.String())),
+		Filters: filters.NewArgs(filters.Arg("until", p.getSettings().expireTime.String())),
 	})
 	if err != nil {
 		log.WithField("err", err).Error("Error pruning build cache", err)
+		journal.Action(pluginName, "prune build cache", journal.Entry{}, err)
+		p.errors++
 	} else if len(report.CachesDeleted) > 0 {
 		log.WithFields(log.Fields{
 			"count": len(report.CachesDeleted),
 			"size":  formatSpace(report.SpaceReclaimed),
 		}).Info("Pruned build caches")
+		pruneRemoved.With("build_cache").Add(float64(len(report.CachesDeleted)))
+		pruneReclaimed.With("build_cache").Add(float64(report.SpaceReclaimed))
+		p.reclaimed += report.SpaceReclaimed
+		journal.Action(pluginName, "prune build cache", journal.Entry{
+			Details: map[string]string{
+				"count": fmt.Sprint(len(report.CachesDeleted)),
+				"size":  formatSpace(report.SpaceReclaimed),
+			},
+		}, nil)
 		return true
 	}
 	return false
@@ -263,7 +543,7 @@ func (p *AutoPruner) updateImageChainExpireTime(leafIds []string) error {
 	log.WithFields(log.Fields{
 		"images": unique(imageIds),
 		"tags":   unique(tags),
-		"expire": (time.Now().Add(p.settings.taggedImageExpireTime)).Format(time.RFC3339),
+		"expire": (time.Now().Add(p.getSettings().taggedImageExpireTime)).Format(time.RFC3339),
 	}).Info("Updated image expiration")
 	return nil
 }
@@ -292,8 +572,11 @@ func (p *AutoPruner) getImageChain(id string) ([]ImageChainItem, error) {
 }
 
 func (p *AutoPruner) updateImageExpireTime(id string) {
-	t := time.Now().Add(p.settings.taggedImageExpireTime)
-	ioutil.WriteFile(p.stateDir+"expire_"+id, []byte(t.Format(time.RFC3339)), 0600)
+	t := time.Now().Add(p.getSettings().taggedImageExpireTime)
+	err := statedir.WriteFile(p.stateDir+"expire_"+id, []byte(t.Format(time.RFC3339)), 0600)
+	if err != nil {
+		log.WithFields(log.Fields{"image": imageIdDisplay(id)}).Error("Error saving image expiration: ", err)
+	}
 }
 
 func (p *AutoPruner) removeImageExpireTime(id string) {
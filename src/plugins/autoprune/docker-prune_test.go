@@ -0,0 +1,153 @@
+package autoprune
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/rules"
+)
+
+func TestMain(m *testing.M) {
+	// adds to the built-in exclusion of Vast.ai containers
+	if _, err := kingpin.CommandLine.Parse([]string{"--autoprune-exclude=name=excluded"}); err != nil {
+		panic(err)
+	}
+	if err := rules.Load(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func newTestPruner(t *testing.T, cli dockerapi.Client) *AutoPruner {
+	return newAutoPruner(context.Background(), cli, t.TempDir()+"/", PruneSettings{
+		expireTime:            time.Hour,
+		taggedImageExpireTime: 24 * time.Hour,
+		pruneInterval:         time.Hour,
+	})
+}
+
+// cid pads the name to a full length container id.
+func cid(name string) string {
+	return name + strings.Repeat("0", 64-len(name))
+}
+
+func addStoppedContainer(cli *dockerapi.Fake, name string, finished time.Time) {
+	ct := dockerapi.FakeContainer(cid(name), name, "ubuntu", nil)
+	ct.State.Status = "exited"
+	ct.State.FinishedAt = finished.UTC().Format(time.RFC3339Nano)
+	cli.AddContainer(ct)
+}
+
+func exists(cli *dockerapi.Fake, name string) bool {
+	_, err := cli.ContainerInspect(context.Background(), cid(name))
+	return err == nil
+}
+
+func TestPruneContainers(t *testing.T) {
+	cli := dockerapi.NewFake()
+	addStoppedContainer(cli, "expired", time.Now().Add(-2*time.Hour))
+	addStoppedContainer(cli, "recent", time.Now().Add(-time.Minute))
+	addStoppedContainer(cli, "C.1", time.Now().Add(-2*time.Hour))
+	addStoppedContainer(cli, "excluded", time.Now().Add(-2*time.Hour))
+	cli.AddContainer(dockerapi.FakeContainer(cid("running"), "running", "ubuntu", nil))
+	cli.StartContainer(cid("running"))
+
+	p := newTestPruner(t, cli)
+	if !p.pruneContainers() {
+		t.Error("nothing was pruned")
+	}
+	if exists(cli, "expired") {
+		t.Error("expired container was not removed")
+	}
+	for _, name := range []string{"recent", "C.1", "excluded", "running"} {
+		if !exists(cli, name) {
+			t.Errorf("container %s was removed", name)
+		}
+	}
+	if p.errors != 0 {
+		t.Errorf("%d errors", p.errors)
+	}
+	if p.pruneContainers() {
+		t.Error("second run pruned again")
+	}
+}
+
+func addTaggedImage(cli *dockerapi.Fake, id string, tag string) {
+	cli.AddImage(dockerapi.FakeImage{
+		Summary: types.ImageSummary{ID: id, RepoTags: []string{tag}, Size: 1 << 20},
+		History: []image.HistoryResponseItem{{ID: id, Tags: []string{tag}}},
+	})
+}
+
+func imageExists(cli *dockerapi.Fake, id string) bool {
+	_, err := cli.ImageHistory(context.Background(), id)
+	return err == nil
+}
+
+func TestPruneImages(t *testing.T) {
+	cli := dockerapi.NewFake()
+	addTaggedImage(cli, "sha256:expired0000000", "old:latest")
+	addTaggedImage(cli, "sha256:unknown0000000", "new:latest")
+	addTaggedImage(cli, "sha256:used00000000000", "used:latest")
+	ct := dockerapi.FakeContainer(cid("c1"), "c1", "used:latest", nil)
+	ct.Image = "sha256:used00000000000"
+	cli.AddContainer(ct)
+
+	p := newTestPruner(t, cli)
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if err := ioutil.WriteFile(p.stateDir+"expire_sha256:expired0000000", []byte(past), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p.stateDir+"expire_sha256:used00000000000", []byte(past), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.pruneImages() {
+		t.Error("nothing was pruned")
+	}
+	if imageExists(cli, "sha256:expired0000000") {
+		t.Error("expired image was not removed")
+	}
+	if !imageExists(cli, "sha256:unknown0000000") || !imageExists(cli, "sha256:used00000000000") {
+		t.Error("image without expiration or in use was removed")
+	}
+
+	// the expiration of an image seen for the first time starts now
+	str, err := ioutil.ReadFile(p.stateDir + "expire_sha256:unknown0000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expire, err := time.Parse(time.RFC3339, string(str)); err != nil || expire.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("unexpected expiration %s (%v)", str, err)
+	}
+}
+
+func TestHealthFailsOnConsecutiveFailedRuns(t *testing.T) {
+	p := newTestPruner(t, dockerapi.NewFake())
+	failed := PruneResult{Finished: time.Now(), Errors: 1, Next: time.Now().Add(time.Hour)}
+	for i := 1; i < maxFailedRuns; i++ {
+		p.record(failed)
+		if _, err := p.health(); err != nil {
+			t.Fatalf("unhealthy after %d failed runs: %v", i, err)
+		}
+	}
+	p.record(failed)
+	if _, err := p.health(); err == nil {
+		t.Errorf("healthy after %d failed runs", maxFailedRuns)
+	}
+
+	// a run which pruned something despite errors is not a failure
+	p.record(PruneResult{Finished: time.Now(), Pruned: true, Errors: 1, Next: time.Now().Add(time.Hour)})
+	if _, err := p.health(); err != nil {
+		t.Errorf("unhealthy after a partly successful run: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package autoprune
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/journal"
+)
+
+// planTempImages logs the dangling images which pruneTempImages would remove.
+// Docker cannot simulate ImagesPrune, so its selection is repeated here:
+// untagged, unused and created before the expire time.
+func (p *AutoPruner) planTempImages() {
+	images, err := p.cli.ImageList(p.ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("dangling", "true")),
+	})
+	if err != nil {
+		log.WithField("err", err).Error("Error listing images")
+		p.errors++
+		return
+	}
+	containers, err := p.cli.ContainerList(p.ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		log.WithField("err", err).Error("Error listing containers")
+		p.errors++
+		return
+	}
+	used := make(map[string]bool)
+	for _, container := range containers {
+		used[container.ImageID] = true
+	}
+
+	cutoff := time.Now().Add(-p.getSettings().expireTime)
+	count := 0
+	size := uint64(0)
+	for _, image := range images {
+		dangling := len(image.RepoTags) == 0 ||
+			(len(image.RepoTags) == 1 && image.RepoTags[0] == "<none>:<none>")
+		if !dangling || used[image.ID] || time.Unix(image.Created, 0).After(cutoff) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"image": imageIdDisplay(image.ID),
+			"size":  formatSpace(uint64(image.Size)),
+		}).Info("Dry run: would remove temporary image")
+		journal.Planned(pluginName, "remove image", journal.Entry{Image: image.ID})
+		count++
+		size += uint64(image.Size)
+	}
+	if count > 0 {
+		journal.Planned(pluginName, "prune temporary images", journal.Entry{
+			Details: map[string]string{
+				"count": fmt.Sprint(count),
+				"size":  formatSpace(size),
+			},
+		})
+	}
+}
+
+// planBuildCache logs the build cache records which pruneBuildCache would
+// remove: not in use and last used before the expire time.
+func (p *AutoPruner) planBuildCache() {
+	usage, err := p.cli.DiskUsage(p.ctx)
+	if err != nil {
+		log.WithField("err", err).Error("Error reading build cache usage")
+		p.errors++
+		return
+	}
+
+	cutoff := time.Now().Add(-p.getSettings().expireTime)
+	count := 0
+	size := uint64(0)
+	for _, record := range usage.BuildCache {
+		lastUsed := record.CreatedAt
+		if record.LastUsedAt != nil {
+			lastUsed = *record.LastUsedAt
+		}
+		if record.InUse || lastUsed.After(cutoff) {
+			continue
+		}
+		count++
+		size += uint64(record.Size)
+	}
+	if count > 0 {
+		log.WithFields(log.Fields{
+			"count": count,
+			"size":  formatSpace(size),
+		}).Info("Dry run: would prune build cache")
+		journal.Planned(pluginName, "prune build cache", journal.Entry{
+			Details: map[string]string{
+				"count": fmt.Sprint(count),
+				"size":  formatSpace(size),
+			},
+		})
+	}
+}
@@ -2,70 +2,120 @@ package autoprune
 
 import (
 	"context"
+	"net/http"
 
-	"github.com/docker/docker/client"
-	"gopkg.in/alecthomas/kingpin.v2"
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/plugins"
+	"vastai-helper/src/rules"
 )
 
+const pluginName = "autoprune"
+
+func init() {
+	plugins.Register(pluginName, "Removes expired containers, images and build cache.",
+		func(ctx context.Context, cli dockerapi.Client, stateDir string) plugins.Plugin {
+			return NewPlugin(ctx, cli, stateDir)
+		})
+}
+
 var (
-	expireTime = kingpin.Flag(
+	expireTime = plugins.Flag(pluginName,
 		"expire-time",
 		"Expire time for stopped containers (non-VastAi), temporary images, build cache.",
 	).Default("24h").Duration()
-	taggedImageExpireTime = kingpin.Flag(
+	taggedImageExpireTime = plugins.Flag(pluginName,
 		"tagged-image-expire-time",
 		"Prune age for tagged images.",
 	).Default("168h").Duration()
-	pruneInterval = kingpin.Flag(
+	pruneInterval = plugins.Flag(pluginName,
 		"prune-interval",
 		"Interval between prune runs.",
 	).Default("4h").Duration()
+	pruneFilter = rules.NewFilter(
+		plugins.Flag(pluginName,
+			"autoprune-include",
+			"Only prune containers matching the rule (repeatable).",
+		),
+		plugins.Flag(pluginName,
+			"autoprune-exclude",
+			"Do not prune containers matching the rule (repeatable). Vast.ai containers (name=C.*) are always excluded.",
+		),
+	).AlwaysExclude("name=C.*")
 )
 
 type AutoPrunePlugin struct {
+	plugins.Base
 	ctx    context.Context
-	cli    *client.Client
+	cli    dockerapi.Client
 	pruner *AutoPruner
 }
 
-func NewPlugin(ctx context.Context, cli *client.Client, stateDir string) *AutoPrunePlugin {
+func NewPlugin(ctx context.Context, cli dockerapi.Client, stateDir string) *AutoPrunePlugin {
 	return &AutoPrunePlugin{
-		ctx: ctx,
-		cli: cli,
-		pruner: newAutoPruner(ctx, cli, stateDir+"prune/", PruneSettings{
-			expireTime:            *expireTime,
-			taggedImageExpireTime: *taggedImageExpireTime,
-			pruneInterval:         *pruneInterval,
-		}),
+		ctx:    ctx,
+		cli:    cli,
+		pruner: newAutoPruner(ctx, cli, stateDir+"prune/", currentSettings()),
 	}
 }
 
-func (p *AutoPrunePlugin) ContainerDiscovered(cid string, cname string, image string) error {
-	return nil
+func currentSettings() PruneSettings {
+	return PruneSettings{
+		expireTime:            *expireTime,
+		taggedImageExpireTime: *taggedImageExpireTime,
+		pruneInterval:         *pruneInterval,
+	}
 }
 
 func (p *AutoPrunePlugin) Start() error {
-	go p.pruner.loop()
+	plugins.AddHealthCheck(pluginName, plugins.Liveness, p.pruner.health)
+	p.pruner.start()
 	return nil
 }
 
-func (p *AutoPrunePlugin) ContainerCreated(cid string, cname string, image string) error {
+func (p *AutoPrunePlugin) Stop(ctx context.Context) error {
+	// the loop exits when the main context is cancelled
+	select {
+	case <-p.pruner.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *AutoPrunePlugin) Reload() error {
+	p.pruner.setSettings(currentSettings())
 	return nil
 }
 
-func (p *AutoPrunePlugin) ContainerDestroyed(cid string, cname string, image string) error {
-	return p.pruner.updateImageChainExpireTime([]string{image})
+func (p *AutoPrunePlugin) AdminHandlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"prune": p.servePrune,
+	}
 }
 
-func (p *AutoPrunePlugin) ContainerStarted(cid string, cname string, image string) error {
-	return nil
+// servePrune returns the result of the last prune run (null if there was
+// none yet), POST starts a run and returns its result.
+func (p *AutoPrunePlugin) servePrune(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		plugins.WriteJson(w, p.pruner.lastResult())
+	case http.MethodPost:
+		result, err := p.pruner.pruneNow(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		plugins.WriteJson(w, result)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
-func (p *AutoPrunePlugin) ContainerStopped(cid string, cname string, image string) error {
-	return nil
+func (p *AutoPrunePlugin) ContainerDestroyed(ctx context.Context, event *plugins.Event) error {
+	return p.pruner.updateImageChainExpireTime([]string{event.Image})
 }
 
-func (p *AutoPrunePlugin) ImageRemoved(image string) error {
-	p.pruner.removeImageExpireTime(image)
+func (p *AutoPrunePlugin) ImageRemoved(ctx context.Context, event *plugins.Event) error {
+	p.pruner.removeImageExpireTime(event.Image)
 	return nil
 }
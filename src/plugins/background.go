@@ -0,0 +1,43 @@
+package plugins
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+)
+
+// restartDelay is the time a background loop which panicked is restarted
+// after.
+const restartDelay = 10 * time.Second
+
+var panicHandler func(plugin string, r interface{}, stack []byte)
+
+// SetPanicHandler sets the function reporting panics of background loops.
+// It must be called before plugins are started.
+func SetPanicHandler(f func(plugin string, r interface{}, stack []byte)) {
+	panicHandler = f
+}
+
+// Supervise runs a background loop of the plugin until it returns. If it
+// panics, the panic is reported like one of a plugin call and the loop is
+// started again, unless ctx was cancelled meanwhile.
+func Supervise(ctx context.Context, plugin string, loop func()) {
+	for !runLoop(plugin, loop) {
+		if !Sleep(ctx, restartDelay) {
+			return
+		}
+	}
+}
+
+// runLoop returns false if the loop panicked.
+func runLoop(plugin string, loop func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if panicHandler != nil {
+				panicHandler(plugin, r, debug.Stack())
+			}
+		}
+	}()
+	loop()
+	return true
+}
@@ -0,0 +1,32 @@
+package plugins
+
+import (
+	"sync/atomic"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	dryRunFlag = kingpin.Flag(
+		"dry-run",
+		"Only log and journal what plugins would remove, attach or route, without doing it.",
+	).Bool()
+
+	dryRun int32 // copied from dryRunFlag by LoadSettings
+)
+
+// LoadSettings copies the flags of this package which plugins read, it must
+// be called whenever the configuration was loaded.
+func LoadSettings() {
+	var value int32
+	if *dryRunFlag {
+		value = 1
+	}
+	atomic.StoreInt32(&dryRun, value)
+}
+
+// DryRun returns true if plugins must not make destructive changes, but log
+// them as "Dry run: would ..." and record them with journal.Planned.
+func DryRun() bool {
+	return atomic.LoadInt32(&dryRun) != 0
+}
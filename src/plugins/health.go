@@ -0,0 +1,78 @@
+package plugins
+
+import (
+	"sort"
+	"sync"
+)
+
+// CheckKind tells which endpoints a health check is reported on.
+type CheckKind int
+
+const (
+	// Liveness checks fail when the daemon is wedged or degraded, they are
+	// reported on /healthz and /readyz.
+	Liveness CheckKind = iota
+	// Readiness checks fail until the daemon is fully started, they are
+	// only reported on /readyz.
+	Readiness
+)
+
+// HealthCheck returns a short description of the checked state, and an error
+// if it is degraded. It must be safe for concurrent use.
+type HealthCheck func() (string, error)
+
+// CheckResult is the outcome of a health check.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Ok      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type registeredCheck struct {
+	kind  CheckKind
+	check HealthCheck
+}
+
+var (
+	healthChecks   = make(map[string]registeredCheck)
+	healthChecksMu sync.Mutex
+)
+
+// AddHealthCheck registers a check under a unique name, replacing a previous
+// check with the same name.
+func AddHealthCheck(name string, kind CheckKind, check HealthCheck) {
+	healthChecksMu.Lock()
+	defer healthChecksMu.Unlock()
+	healthChecks[name] = registeredCheck{kind, check}
+}
+
+// RunHealthChecks runs the liveness checks, and the readiness checks too if
+// readiness is set. It returns the results sorted by name and whether all
+// checks passed.
+func RunHealthChecks(readiness bool) ([]CheckResult, bool) {
+	healthChecksMu.Lock()
+	checks := make(map[string]registeredCheck, len(healthChecks))
+	for name, c := range healthChecks {
+		checks[name] = c
+	}
+	healthChecksMu.Unlock()
+
+	results := []CheckResult{}
+	healthy := true
+	for name, c := range checks {
+		if c.kind == Readiness && !readiness {
+			continue
+		}
+		message, err := c.check()
+		result := CheckResult{Name: name, Ok: err == nil, Message: message}
+		if err != nil {
+			result.Message = err.Error()
+			healthy = false
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, healthy
+}
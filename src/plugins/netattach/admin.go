@@ -0,0 +1,106 @@
+package netattach
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+
+	"vastai-helper/src/plugins"
+)
+
+// LeaseInfo is a DHCPv4 lease as listed on the admin socket.
+type LeaseInfo struct {
+	ClientId string    `json:"clientId"` // container id
+	HostName string    `json:"hostName"`
+	Ip       string    `json:"ip"`
+	Gateway  string    `json:"gateway"`
+	Renewed  time.Time `json:"renewed"`
+	Ttl      string    `json:"ttl"`
+}
+
+// AttachmentInfo is a container attached to the public network.
+type AttachmentInfo struct {
+	ContainerId   string   `json:"containerId"`
+	ContainerName string   `json:"containerName"`
+	Ipv6          string   `json:"ipv6,omitempty"`
+	Ipv4          string   `json:"ipv4,omitempty"`
+	Rules         []string `json:"rules,omitempty"` // ip6tables rules routing its ports
+}
+
+func (p *NetAttachPlugin) AdminHandlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"leases":      p.serveLeases,
+		"attachments": p.serveAttachments,
+	}
+}
+
+func (p *NetAttachPlugin) serveLeases(w http.ResponseWriter, r *http.Request) {
+	result := []LeaseInfo{}
+	if p.enabled && p.net.driver == "ipvlan" {
+		leases, err := loadAllLeases()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, lease := range leases {
+			info := LeaseInfo{
+				ClientId: hex.EncodeToString(lease.ClientId),
+				HostName: lease.HostName,
+				Ip:       lease.Ip().String(),
+				Renewed:  lease.Renewed,
+				Ttl:      lease.Ttl.String(),
+			}
+			if gateway := lease.Gateway(); gateway != nil {
+				info.Gateway = gateway.String()
+			}
+			result = append(result, info)
+		}
+	}
+	plugins.WriteJson(w, result)
+}
+
+func (p *NetAttachPlugin) serveAttachments(w http.ResponseWriter, r *http.Request) {
+	result := []AttachmentInfo{}
+	if !p.enabled || p.net.id == "" {
+		// not created in dry-run mode
+		plugins.WriteJson(w, result)
+		return
+	}
+	network, err := p.cli.NetworkInspect(r.Context(), p.net.id, types.NetworkInspectOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rules := make(map[string][]string)
+	if p.net.driver == "bridge" {
+		ipt, err := newIp6tables()
+		if err == nil {
+			var list []PortRule
+			list, err = listPortRules(ipt)
+			for _, rule := range list {
+				rules[rule.cid] = append(rules[rule.cid], strings.Join(rule.spec, " "))
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for cid, endpoint := range network.Containers {
+		result = append(result, AttachmentInfo{
+			ContainerId:   cid,
+			ContainerName: endpoint.Name,
+			Ipv6:          endpoint.IPv6Address,
+			Ipv4:          endpoint.IPv4Address,
+			Rules:         rules[cid],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ContainerName < result[j].ContainerName
+	})
+	plugins.WriteJson(w, result)
+}
@@ -12,6 +12,8 @@ import (
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
 	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/statedir"
 )
 
 type DhcpLeaseV4 struct {
@@ -79,7 +81,7 @@ func (lease DhcpLeaseV4) save() error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(leaseStateFile(lease.ClientId), j, 0600)
+	return statedir.WriteFile(leaseStateFile(lease.ClientId), j, 0600)
 }
 
 func (lease DhcpLeaseV4) Ip() net.IP {
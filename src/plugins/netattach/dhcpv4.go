@@ -11,6 +11,9 @@ import (
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+
+	"vastai-helper/src/journal"
+	"vastai-helper/src/plugins"
 )
 
 func dhcpLeaseV4(ctx context.Context, ifname string, clientId []byte, hostName string, prefIp net.IP) (DhcpLeaseV4, error) {
@@ -70,6 +73,7 @@ func dhcpRenewAllV4(ctx context.Context) error {
 	for _, lease := range leases {
 		newLease, err := lease.renewIfNeeded(ctx)
 		if err != nil {
+			dhcpRenewFailures.With("dhcpv4").Inc()
 			log.Error(err)
 			continue
 		}
@@ -77,6 +81,24 @@ func dhcpRenewAllV4(ctx context.Context) error {
 			// TODO what to do?
 			log.WithFields(newLease.logFields()).
 				Errorf("IP changed in DHCP lease (was %s)", lease.Ip())
+			journal.Action(pluginName, "lease ip change", journal.Entry{
+				Cid:   hex.EncodeToString(newLease.ClientId),
+				Cname: newLease.HostName,
+				Details: map[string]string{
+					"old.ip": lease.Ip().String(),
+					"new.ip": newLease.Ip().String(),
+				},
+			}, nil)
+			plugins.Notify(plugins.Notice{
+				Kind:          "lease_ip_change",
+				Plugin:        pluginName,
+				ContainerId:   hex.EncodeToString(newLease.ClientId),
+				ContainerName: newLease.HostName,
+				Details: map[string]string{
+					"old.ip": lease.Ip().String(),
+					"new.ip": newLease.Ip().String(),
+				},
+			})
 		}
 		if !newLease.Gateway().Equal(lease.Gateway()) {
 			log.WithFields(newLease.logFields()).
@@ -86,9 +108,10 @@ func dhcpRenewAllV4(ctx context.Context) error {
 	return nil
 }
 
+// dhcpRenewLoopV4 runs until the context is cancelled. Leases are renewed
+// in dry-run mode as well, they are used by containers attached before.
 func dhcpRenewLoopV4(ctx context.Context) {
-	for {
-		time.Sleep(time.Minute)
+	for plugins.Sleep(ctx, time.Minute) {
 		err := dhcpRenewAllV4(ctx)
 		if err != nil {
 			log.Error(err)
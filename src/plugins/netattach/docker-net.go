@@ -11,7 +11,9 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/plugins"
 )
 
 type DockerNet struct {
@@ -25,7 +27,7 @@ type DockerNet struct {
 	ifname    string // for ipvlan only
 }
 
-func selectOrCreateDockerNet(ctx context.Context, cli *client.Client, netConf *NetConf) (DockerNet, error) {
+func selectOrCreateDockerNet(ctx context.Context, cli dockerapi.Client, netConf *NetConf) (DockerNet, error) {
 	driver := "bridge"
 	if netConf.netType == Ipvlan {
 		driver = "ipvlan"
@@ -46,7 +48,7 @@ func selectOrCreateDockerNet(ctx context.Context, cli *client.Client, netConf *N
 	return createDockerNet(ctx, cli, driver, netConf)
 }
 
-func enumDockerNets(ctx context.Context, cli *client.Client, driver string) ([]DockerNet, error) {
+func enumDockerNets(ctx context.Context, cli dockerapi.Client, driver string) ([]DockerNet, error) {
 	log.Infof("Enumerating %s networks created by vastai-helper", driver)
 
 	resp, err := cli.NetworkList(ctx, types.NetworkListOptions{})
@@ -102,7 +104,7 @@ func isNetSuitable(net DockerNet, netConf *NetConf) bool {
 		net.ifname == netConf.ifname
 }
 
-func createDockerNet(ctx context.Context, cli *client.Client, driver string, netConf *NetConf) (DockerNet, error) {
+func createDockerNet(ctx context.Context, cli dockerapi.Client, driver string, netConf *NetConf) (DockerNet, error) {
 	log.Infof("Will create new %s network", driver)
 
 	name := "vastai-net"
@@ -143,6 +145,12 @@ func createDockerNet(ctx context.Context, cli *client.Client, driver string, net
 		})
 	}
 
+	if plugins.DryRun() {
+		// plan attachments to the network as if it existed
+		log.WithFields(dockerNet.logFields()).Info("Dry run: would create network")
+		return dockerNet, nil
+	}
+
 	resp, err := cli.NetworkCreate(ctx, dockerNet.name, types.NetworkCreate{
 		CheckDuplicate: true,
 		Driver:         driver,
@@ -163,7 +171,7 @@ func createDockerNet(ctx context.Context, cli *client.Client, driver string, net
 	return dockerNet, nil
 }
 
-func netExists(ctx context.Context, cli *client.Client, name string) bool {
+func netExists(ctx context.Context, cli dockerapi.Client, name string) bool {
 	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{
 		Filters: filters.NewArgs(filters.Arg("name", name)),
 	})
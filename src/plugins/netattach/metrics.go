@@ -0,0 +1,49 @@
+package netattach
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/metrics"
+)
+
+var dhcpRenewFailures = metrics.NewCounterVec(
+	"dhcp_renew_failures_total",
+	"Failed DHCP renewals, by protocol.",
+	"protocol",
+)
+
+// registerMetrics adds the gauges which depend on the selected network type,
+// once the network is set up.
+func registerMetrics(netType NetType) {
+	switch netType {
+	case Ipvlan:
+		metrics.NewGaugeFunc(
+			"dhcp_leases",
+			"DHCPv4 leases held for containers.",
+			func() float64 {
+				leases, err := loadAllLeases()
+				if err != nil {
+					log.Error(err)
+				}
+				return float64(len(leases))
+			},
+		)
+	case Bridge:
+		metrics.NewGaugeFunc(
+			"ip6tables_rules",
+			"ip6tables rules installed for container ports.",
+			func() float64 {
+				ipt, err := newIp6tables()
+				if err != nil {
+					log.Error(err)
+					return 0
+				}
+				rules, err := listPortRules(ipt)
+				if err != nil {
+					log.Error(err)
+				}
+				return float64(len(rules))
+			},
+		)
+	}
+}
@@ -10,9 +10,13 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/journal"
+	"vastai-helper/src/plugins"
 )
 
 type PortRange struct {
@@ -29,11 +33,32 @@ type Attachment struct {
 	ipv6  net.IP
 }
 
-func attachContainerToNet(ctx context.Context, cli *client.Client, att *Attachment) error {
+func attachContainerToNet(ctx context.Context, cli dockerapi.Client, att *Attachment) error {
+	// reconciliation replays the creation of containers attached before a
+	// restart which have no lease or port rules
+	ctJson, err := cli.ContainerInspect(ctx, att.cid)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctJson.NetworkSettings.Networks[att.net.name]; ok {
+		return nil
+	}
+
 	// ipv6
 	att.ipv6 = randomIp(att.net.v6prefix)
 	ipv6str := att.ipv6.String()
 
+	if plugins.DryRun() {
+		logger := log.WithFields(att.logFields()).
+			WithFields(log.Fields{"net": att.net.name, "v6.ip": ipv6str})
+		if att.net.driver == "ipvlan" {
+			logger.WithFields(log.Fields{"ifname": att.net.ifname}).Info("Dry run: would request DHCPv4 lease")
+		}
+		logger.Info("Dry run: would attach container to network")
+		att.plan("attach", map[string]string{"net": att.net.name, "v6.ip": ipv6str})
+		return nil
+	}
+
 	// ipv4 (for ipvlan only)
 	ipv4str := ""
 	if att.net.driver == "ipvlan" {
@@ -56,20 +81,85 @@ func attachContainerToNet(ctx context.Context, cli *client.Client, att *Attachme
 	if ipv4str != "" {
 		ipamConfig.IPv4Address = ipv4str
 	}
-	return cli.NetworkConnect(ctx, att.net.id, att.cid,
+	err = cli.NetworkConnect(ctx, att.net.id, att.cid,
 		&network.EndpointSettings{IPAMConfig: &ipamConfig})
+	att.record("attach", map[string]string{"net": att.net.name, "v6.ip": ipv6str, "v4.ip": ipv4str}, err)
+	return err
 }
 
-func detachContainerFromNet(ctx context.Context, cli *client.Client, att *Attachment) error {
-	if att.net.driver == "ipvlan" {
-		err := dhcpReleaseV4(ctx, makeDhcpClientId(att.cid))
-		if err != nil {
+func detachContainerFromNet(ctx context.Context, cli dockerapi.Client, att *Attachment) error {
+	if att.net.driver != "ipvlan" {
+		return nil
+	}
+	if plugins.DryRun() {
+		log.WithFields(att.logFields()).Info("Dry run: would release DHCPv4 lease")
+		att.plan("release lease", nil)
+		return nil
+	}
+	err := dhcpReleaseV4(ctx, makeDhcpClientId(att.cid))
+	att.record("release lease", nil, err)
+	return err
+}
+
+// reattachContainerToNet restores the attachment of a running container
+// which was manually disconnected from the network.
+func reattachContainerToNet(ctx context.Context, cli dockerapi.Client, att *Attachment) error {
+	ctJson, err := cli.ContainerInspect(ctx, att.cid)
+	if err != nil {
+		return err
+	}
+	if !ctJson.State.Running || ctJson.State.Restarting {
+		// disconnected because the container stopped
+		return nil
+	}
+	if _, ok := ctJson.NetworkSettings.Networks[att.net.name]; ok {
+		return nil
+	}
+
+	log.WithFields(att.logFields()).
+		WithFields(log.Fields{"net": att.net.name}).
+		Warn("Container was disconnected from network, reattaching")
+	details := map[string]string{"net": att.net.name}
+	if plugins.DryRun() {
+		att.plan("reattach", details)
+		return reattach(ctx, cli, att)
+	}
+	err = reattach(ctx, cli, att)
+	att.record("reattach", details, err)
+	return err
+}
+
+func reattach(ctx context.Context, cli dockerapi.Client, att *Attachment) error {
+	if att.net.driver == "bridge" {
+		if err := unroutePorts(ctx, cli, att); err != nil {
 			return err
 		}
 	}
+	if err := attachContainerToNet(ctx, cli, att); err != nil {
+		return err
+	}
+	if att.net.driver == "bridge" {
+		return routePorts(ctx, cli, att)
+	}
 	return nil
 }
 
+func (att *Attachment) record(action string, details map[string]string, err error) {
+	journal.Action(pluginName, action, journal.Entry{
+		Cid:     att.cid,
+		Cname:   att.cname,
+		Details: details,
+	}, err)
+}
+
+func (att *Attachment) plan(action string, details map[string]string) {
+	journal.Planned(pluginName, action, journal.Entry{
+		Cid:     att.cid,
+		Cname:   att.cname,
+		Details: details,
+	})
+}
+
 func randomIp(prefix net.IPNet) net.IP {
 	result := make([]byte, 16)
 	rand.Read(result)
@@ -79,15 +169,7 @@ func randomIp(prefix net.IPNet) net.IP {
 	return result
 }
 
-func routePorts(ctx context.Context, cli *client.Client, att *Attachment) error {
-	return routeOrUnroutePorts(ctx, cli, att, false)
-}
-
-func unroutePorts(ctx context.Context, cli *client.Client, att *Attachment) error {
-	return routeOrUnroutePorts(ctx, cli, att, true)
-}
-
-func routeOrUnroutePorts(ctx context.Context, cli *client.Client, att *Attachment, unroute bool) error {
+func routePorts(ctx context.Context, cli dockerapi.Client, att *Attachment) error {
 	ranges, err := portsToExpose(ctx, cli, att)
 	if err != nil {
 		return err
@@ -95,34 +177,30 @@ func routeOrUnroutePorts(ctx context.Context, cli *client.Client, att *Attachmen
 	if len(ranges) == 0 {
 		return nil
 	}
-	var text1, text2 string
-	if !unroute {
-		text1 = "Exposing ports"
-		text2 = "Adding ip6tables rule"
-	} else {
-		text1 = "Unexposing ports"
-		text2 = "Removing ip6tables rule"
-	}
 	logger1 := log.WithFields(att.logFields())
+	if plugins.DryRun() {
+		for _, r := range ranges {
+			rule := r.iptablesRule(att.ipv6, att.cid)
+			logger1.WithFields(log.Fields{"rule": strings.Join(rule, " ")}).Info("Dry run: would add ip6tables rule")
+			att.plan("add rule", map[string]string{"rule": strings.Join(rule, " ")})
+		}
+		return nil
+	}
 	logger1.
 		WithFields(log.Fields{"ports": rangesToString(ranges)}).
-		Info(text1)
+		Info("Exposing ports")
 
-	ipt, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv6), iptables.Timeout(1))
+	ipt, err := newIp6tables()
 	if err != nil {
 		return err
 	}
 
 	for _, r := range ranges {
-		rule := r.iptablesRule(att.ipv6)
+		rule := r.iptablesRule(att.ipv6, att.cid)
 		logger2 := logger1.WithFields(log.Fields{"rule": strings.Join(rule, " ")})
-		logger2.Info(text2)
-		var err error
-		if !unroute {
-			err = ipt.AppendUnique("filter", "FORWARD", rule...)
-		} else {
-			err = ipt.DeleteIfExists("filter", "FORWARD", rule...)
-		}
+		logger2.Info("Adding ip6tables rule")
+		err := ipt.AppendUnique("filter", "FORWARD", rule...)
+		att.record("add rule", map[string]string{"rule": strings.Join(rule, " ")}, err)
 		if err != nil {
 			logger1.Error(err)
 		}
@@ -132,7 +210,200 @@ func routeOrUnroutePorts(ctx context.Context, cli *client.Client, att *Attachmen
 	// TODO policy=DROP
 }
 
-func portsToExpose(ctx context.Context, cli *client.Client, att *Attachment) ([]PortRange, error) {
+func unroutePorts(ctx context.Context, cli dockerapi.Client, att *Attachment) error {
+	// rules are found by their comment, so this works for containers which
+	// no longer exist as well
+	ipt, err := newIp6tables()
+	if err != nil {
+		return err
+	}
+	rules, err := listPortRules(ipt)
+	if err != nil {
+		return err
+	}
+	logger1 := log.WithFields(att.logFields())
+	for _, r := range rules {
+		if r.cid != att.cid {
+			continue
+		}
+		logger2 := logger1.WithFields(log.Fields{"rule": strings.Join(r.spec, " ")})
+		if plugins.DryRun() {
+			logger2.Info("Dry run: would remove ip6tables rule")
+			att.plan("remove rule", map[string]string{"rule": strings.Join(r.spec, " ")})
+			continue
+		}
+		logger2.Info("Removing ip6tables rule")
+		err := ipt.Delete("filter", "FORWARD", r.spec...)
+		att.record("remove rule", map[string]string{"rule": strings.Join(r.spec, " ")}, err)
+		if err != nil {
+			logger1.Error(err)
+		}
+	}
+	return nil
+}
+
+type PortRule struct {
+	cid  string
+	spec []string
+}
+
+// listPortRules returns the FORWARD rules added by routePorts.
+func listPortRules(ipt *iptables.IPTables) ([]PortRule, error) {
+	lines, err := ipt.List("filter", "FORWARD")
+	if err != nil {
+		return []PortRule{}, err
+	}
+	result := []PortRule{}
+	for _, spec := range ruleSpecs(lines) {
+		if comment := ruleOption(spec, "--comment"); strings.HasPrefix(comment, ruleCommentPrefix) {
+			result = append(result, PortRule{
+				cid:  strings.TrimPrefix(comment, ruleCommentPrefix),
+				spec: spec,
+			})
+		}
+	}
+	return result, nil
+}
+
+// ruleSpecs returns the rules of "iptables -S CHAIN" output without the
+// "-A CHAIN" part.
+func ruleSpecs(lines []string) [][]string {
+	result := [][]string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		spec := fields[2:]
+		for i := range spec {
+			spec[i] = strings.Trim(spec[i], `"`)
+		}
+		result = append(result, spec)
+	}
+	return result
+}
+
+// ruleOption returns the value of the option in the rule, "" if not set.
+func ruleOption(spec []string, option string) string {
+	for i := 0; i+1 < len(spec); i++ {
+		if spec[i] == option {
+			return spec[i+1]
+		}
+	}
+	return ""
+}
+
+// LegacyPortRule is an untagged rule added by routePorts of versions which
+// did not tag rules with the container id.
+type LegacyPortRule struct {
+	ip   net.IP
+	spec []string
+}
+
+// legacyPortRules returns the untagged port rules for addresses in prefix.
+func legacyPortRules(lines []string, prefix net.IPNet) []LegacyPortRule {
+	result := []LegacyPortRule{}
+	for _, spec := range ruleSpecs(lines) {
+		if ruleOption(spec, "-j") != "ACCEPT" || ruleOption(spec, "--dport") == "" ||
+			ruleOption(spec, "--comment") != "" {
+			continue
+		}
+		dest := ruleOption(spec, "-d")
+		ip, _, err := net.ParseCIDR(dest)
+		if err != nil {
+			ip = net.ParseIP(dest)
+		}
+		if ip != nil && prefix.Contains(ip) {
+			result = append(result, LegacyPortRule{ip: ip, spec: spec})
+		}
+	}
+	return result
+}
+
+// taggedRule returns the legacy rule with the comment routePorts adds.
+func (r *LegacyPortRule) taggedRule(cid string) []string {
+	tagged := []string{}
+	for i := 0; i < len(r.spec); i++ {
+		if r.spec[i] == "-j" {
+			tagged = append(tagged, "-m", "comment", "--comment", ruleCommentPrefix+cid)
+		}
+		tagged = append(tagged, r.spec[i])
+	}
+	return tagged
+}
+
+// migratePortRules tags the untagged port rules left by previous versions
+// with the id of the container attached with the address, so that they are
+// removed with it. Rules for addresses no longer in use are removed.
+func migratePortRules(ctx context.Context, cli dockerapi.Client, dockerNet *DockerNet) error {
+	ipt, err := newIp6tables()
+	if err != nil {
+		return err
+	}
+	lines, err := ipt.List("filter", "FORWARD")
+	if err != nil {
+		return err
+	}
+	legacy := legacyPortRules(lines, dockerNet.v6prefix)
+	if len(legacy) == 0 {
+		return nil
+	}
+	netJson, err := cli.NetworkInspect(ctx, dockerNet.id, types.NetworkInspectOptions{})
+	if err != nil {
+		return err
+	}
+	owners := make(map[string]*Attachment) // by address
+	for cid, endpoint := range netJson.Containers {
+		if ip, _, err := net.ParseCIDR(endpoint.IPv6Address); err == nil {
+			owners[ip.String()] = &Attachment{cid: cid, cname: endpoint.Name, net: dockerNet, ipv6: ip}
+		}
+	}
+
+	for _, r := range legacy {
+		rule := strings.Join(r.spec, " ")
+		att, ok := owners[r.ip.String()]
+		if !ok {
+			att = &Attachment{net: dockerNet, ipv6: r.ip}
+		}
+		logger := log.WithFields(att.logFields()).WithFields(log.Fields{"rule": rule})
+		if ok {
+			tagged := r.taggedRule(att.cid)
+			if plugins.DryRun() {
+				logger.Info("Dry run: would tag ip6tables rule")
+				att.plan("tag rule", map[string]string{"rule": rule})
+				continue
+			}
+			logger.Info("Tagging ip6tables rule with container id")
+			err := ipt.AppendUnique("filter", "FORWARD", tagged...)
+			if err == nil {
+				err = ipt.Delete("filter", "FORWARD", r.spec...)
+			}
+			att.record("tag rule", map[string]string{"rule": rule}, err)
+			if err != nil {
+				logger.Error(err)
+			}
+			continue
+		}
+		if plugins.DryRun() {
+			logger.Info("Dry run: would remove ip6tables rule of detached address")
+			att.plan("remove rule", map[string]string{"rule": rule})
+			continue
+		}
+		logger.Info("Removing ip6tables rule of detached address")
+		err := ipt.Delete("filter", "FORWARD", r.spec...)
+		att.record("remove rule", map[string]string{"rule": rule}, err)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+	return nil
+}
+
+func newIp6tables() (*iptables.IPTables, error) {
+	return iptables.New(iptables.IPFamily(iptables.ProtocolIPv6), iptables.Timeout(1))
+}
+
+func portsToExpose(ctx context.Context, cli dockerapi.Client, att *Attachment) ([]PortRange, error) {
 	// TODO save ContainerInspect call by getting data from InfoCache
 
 	ranges := []PortRange{}
@@ -150,6 +421,10 @@ func portsToExpose(ctx context.Context, cli *client.Client, att *Attachment) ([]
 			}
 		}
 	}
+	if att.ipv6 == nil && plugins.DryRun() {
+		// not attached in dry-run mode, show the rules with the prefix
+		att.ipv6 = att.net.v6prefix.IP
+	}
 	if att.ipv6 == nil {
 		return ranges, nil
 	}
@@ -185,7 +460,10 @@ func singlePort(port int) PortRange {
 	}
 }
 
-func (r *PortRange) iptablesRule(ip net.IP) []string {
+// ruleCommentPrefix tags ip6tables rules with the id of the container.
+const ruleCommentPrefix = "vastai-helper:"
+
+func (r *PortRange) iptablesRule(ip net.IP, cid string) []string {
 	dport := ""
 	if r.startPort == r.endPort {
 		dport = fmt.Sprintf("%d", r.startPort)
@@ -196,6 +474,7 @@ func (r *PortRange) iptablesRule(ip net.IP) []string {
 		"-d", ip.String(),
 		"-p", r.proto,
 		"--dport", dport,
+		"-m", "comment", "--comment", ruleCommentPrefix + cid,
 		"-j", "ACCEPT",
 	}
 }
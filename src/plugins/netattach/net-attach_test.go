@@ -0,0 +1,113 @@
+package netattach
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+
+	"vastai-helper/src/dockerapi"
+)
+
+const testCid = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func testNet(t *testing.T, cli *dockerapi.Fake) *DockerNet {
+	_, prefix, err := net.ParseCIDR("2001:db8:1::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.AddNetwork(types.NetworkResource{ID: "netid", Name: "vastai", Driver: "bridge"})
+	return &DockerNet{id: "netid", name: "vastai", driver: "bridge", v6prefix: *prefix}
+}
+
+func TestBridgePortRouting(t *testing.T) {
+	ctx := context.Background()
+	cli := dockerapi.NewFake()
+	dockerNet := testNet(t, cli)
+	ct := dockerapi.FakeContainer(testCid, "C.1/ssh", "pytorch", nil)
+	ct.Config.ExposedPorts = nat.PortSet{"8000-8010/tcp": {}, "53/udp": {}}
+	cli.AddContainer(ct)
+
+	att := &Attachment{cid: testCid, cname: "C.1/ssh", net: dockerNet}
+	if err := attachContainerToNet(ctx, cli, att); err != nil {
+		t.Fatal(err)
+	}
+	if !dockerNet.v6prefix.Contains(att.ipv6) {
+		t.Fatalf("address %s not in %s", att.ipv6, &dockerNet.v6prefix)
+	}
+	// as when reconciliation replays the creation
+	if err := attachContainerToNet(ctx, cli, &Attachment{cid: testCid, cname: "C.1/ssh", net: dockerNet}); err != nil {
+		t.Errorf("attaching an attached container: %v", err)
+	}
+
+	// a fresh attachment, as for the start event, finds the address
+	started := &Attachment{cid: testCid, cname: "C.1/ssh", net: dockerNet}
+	ranges, err := portsToExpose(ctx, cli, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !started.ipv6.Equal(att.ipv6) {
+		t.Errorf("address %s, want %s", started.ipv6, att.ipv6)
+	}
+	got := []string{}
+	for _, r := range ranges {
+		got = append(got, strings.Join(r.iptablesRule(started.ipv6, testCid), " "))
+	}
+	sort.Strings(got)
+	ip := att.ipv6.String()
+	want := []string{
+		"-d " + ip + " -p tcp --dport 22 -m comment --comment vastai-helper:" + testCid + " -j ACCEPT",
+		"-d " + ip + " -p tcp --dport 8000:8010 -m comment --comment vastai-helper:" + testCid + " -j ACCEPT",
+		"-d " + ip + " -p udp --dport 53 -m comment --comment vastai-helper:" + testCid + " -j ACCEPT",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rules\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPortsNotExposedWithoutAddress(t *testing.T) {
+	ctx := context.Background()
+	cli := dockerapi.NewFake()
+	dockerNet := testNet(t, cli)
+	ct := dockerapi.FakeContainer(testCid, "C.1/jupyter", "pytorch", nil)
+	ct.Config.ExposedPorts = nat.PortSet{"8080/tcp": {}}
+	cli.AddContainer(ct)
+
+	ranges, err := portsToExpose(ctx, cli, &Attachment{cid: testCid, cname: "C.1/jupyter", net: dockerNet})
+	if err != nil || len(ranges) != 0 {
+		t.Errorf("ports %v (%v) for a container not attached", ranges, err)
+	}
+}
+
+func TestLegacyPortRules(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	lines := []string{
+		"-P FORWARD DROP",
+		"-A FORWARD -d 2001:db8:1::5/128 -p tcp -m tcp --dport 22 -j ACCEPT",
+		"-A FORWARD -d 2001:db8:1::5/128 -p udp -m udp --dport 8000:8010 -j ACCEPT",
+		`-A FORWARD -d 2001:db8:1::6/128 -p tcp -m tcp --dport 22 -m comment --comment "vastai-helper:` + testCid + `" -j ACCEPT`,
+		"-A FORWARD -d 2001:db8:2::5/128 -p tcp -m tcp --dport 22 -j ACCEPT",
+		"-A FORWARD -d 2001:db8:1::7/128 -j ACCEPT",
+		"-A FORWARD -i eth0 -o docker0 -j DOCKER",
+	}
+	legacy := legacyPortRules(lines, *prefix)
+	if len(legacy) != 2 {
+		t.Fatalf("found %d legacy rules, want 2: %v", len(legacy), legacy)
+	}
+	if !legacy[0].ip.Equal(net.ParseIP("2001:db8:1::5")) {
+		t.Errorf("address %s", legacy[0].ip)
+	}
+	want := "-d 2001:db8:1::5/128 -p tcp -m tcp --dport 22 -m comment --comment vastai-helper:" + testCid + " -j ACCEPT"
+	if got := strings.Join(legacy[0].taggedRule(testCid), " "); got != want {
+		t.Errorf("tagged rule %q, want %q", got, want)
+	}
+
+	tagged := ruleSpecs(lines[3:4])
+	if len(tagged) != 1 || ruleOption(tagged[0], "--comment") != ruleCommentPrefix+testCid {
+		t.Errorf("unexpected tagged rule %v", tagged)
+	}
+}
@@ -3,9 +3,13 @@ package netattach
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/plugins"
 )
 
 type DhcpKeeper struct {
@@ -13,9 +17,15 @@ type DhcpKeeper struct {
 	netConf      NetConf
 	sharedPrefix bool
 	ctx          context.Context
+	mu           sync.Mutex // guards the renewal state below
+	renewed      time.Time
+	failingSince time.Time
+	lastErr      error
 }
 
-func dhcpNetConfV6(ctx context.Context, ifname string, sharedPrefix bool) (NetConf, error) {
+// dhcpNetConfV6 receives the initial configuration, renewLoop must be run
+// to keep it up to date.
+func dhcpNetConfV6(ctx context.Context, ifname string, sharedPrefix bool) (*DhcpKeeper, error) {
 	keeper := DhcpKeeper{
 		ifname:       ifname,
 		ctx:          ctx,
@@ -23,10 +33,10 @@ func dhcpNetConfV6(ctx context.Context, ifname string, sharedPrefix bool) (NetCo
 	}
 	err := keeper.renew()
 	if err != nil {
-		return NetConf{}, err
+		return nil, err
 	}
-	go keeper.renewLoop()
-	return keeper.netConf, nil
+	keeper.renewed = time.Now()
+	return &keeper, nil
 }
 
 func (c *DhcpKeeper) renew() error {
@@ -40,22 +50,52 @@ func (c *DhcpKeeper) renew() error {
 		return errors.New("Delegated prefix must be between /48 and /96 in length")
 	}
 
+	c.mu.Lock()
 	c.netConf = netConf
+	c.mu.Unlock()
 	return nil
 }
 
+func (c *DhcpKeeper) setRenewResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.renewed = time.Now()
+	} else if c.lastErr == nil {
+		c.failingSince = time.Now()
+	}
+	c.lastErr = err
+}
+
+// health reports whether the last renewal succeeded.
+func (c *DhcpKeeper) health() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastErr != nil {
+		return "", fmt.Errorf("renewal failing since %s: %v", c.failingSince.Format(time.RFC3339), c.lastErr)
+	}
+	return "prefix " + c.netConf.v6.prefix.String() + " renewed " + c.renewed.Format(time.RFC3339), nil
+}
+
+// renewLoop runs until the context is cancelled.
 func (c *DhcpKeeper) renewLoop() {
 	// TODO what to do if the prefix changes or expires?
 	for {
-		time.Sleep(c.netConf.v6.preferredLifetime)
+		if !plugins.Sleep(c.ctx, c.netConf.v6.preferredLifetime) {
+			return
+		}
 		for {
 			err := c.renew()
+			c.setRenewResult(err)
 			if err == nil {
 				break
 			}
 			delay := 15 * time.Minute
+			dhcpRenewFailures.With("dhcpv6").Inc()
 			log.WithFields(log.Fields{"retry": delay}).Error(err)
-			time.Sleep(delay)
+			if !plugins.Sleep(c.ctx, delay) {
+				return
+			}
 		}
 	}
 }
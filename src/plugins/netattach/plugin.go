@@ -2,62 +2,125 @@ package netattach
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
-	"strings"
+	"sync"
 
-	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/plugins"
+	"vastai-helper/src/rules"
 )
 
+const pluginName = "netattach"
+
+func init() {
+	plugins.Register(pluginName, "Attaches containers to a public IPv6 network and routes their ports.",
+		func(ctx context.Context, cli dockerapi.Client, stateDir string) plugins.Plugin {
+			return NewPlugin(ctx, cli, stateDir)
+		})
+}
+
 var (
 	// network attach functionality
-	netTypeArg = kingpin.Flag(
+	netTypeArg = plugins.Flag(pluginName,
 		"net-type",
 		"Network type: 'bridge' or 'ipvlan'.",
 	).String()
-	netInterface = kingpin.Flag(
+	netInterface = plugins.Flag(pluginName,
 		"net-interface",
 		"Network interface for DHCPv4 and DHCPv6-PD queries.",
 	).String()
-	ipv6Prefix = kingpin.Flag(
+	ipv6Prefix = plugins.Flag(pluginName,
 		"ipv6-prefix",
 		"Static IPv6 prefix for address assignment (length from /48 to /96).",
 	).String()
-	ipv6Gateway = kingpin.Flag(
+	ipv6Gateway = plugins.Flag(pluginName,
 		"ipv6-gateway",
 		"Static IPv6 gateway address (must be inside --ipv6-prefix).",
 	).String()
 
+	attachFilter = rules.NewFilter(
+		plugins.Flag(pluginName,
+			"netattach-include",
+			"Only attach containers matching the rule (repeatable).",
+		),
+		plugins.Flag(pluginName,
+			"netattach-exclude",
+			"Do not attach containers matching the rule (repeatable). Vast.ai containers (name=C.*) and promtail are always excluded.",
+		),
+	).AlwaysExclude("name=C.*", "name=promtail")
+
 	// testing
-	test = kingpin.Flag(
+	test = plugins.Flag(pluginName,
 		"test",
 		"Perform a self-test of network attach functionality of the running daemon.",
 	).Bool()
-	debug = kingpin.Flag(
+	debug = plugins.Flag(pluginName,
 		"debug",
 		"Print DHCP packets.",
 	).Bool()
 )
 
+// SelfTestRequested returns true if the process only runs the self-test,
+// next to the running daemon.
+func SelfTestRequested() bool {
+	return *test
+}
+
 type NetAttachPlugin struct {
+	plugins.Base
 	ctx      context.Context
-	cli      *client.Client
+	cli      dockerapi.Client
 	enabled  bool
 	net      DockerNet
 	stateDir string
+	wg       sync.WaitGroup // background loops
+	settings NetSettings
+	selected chan struct{} // closed when network selection is finished
 }
 
-func NewPlugin(ctx context.Context, cli *client.Client, stateDir string) *NetAttachPlugin {
-	return &NetAttachPlugin{
+// NetSettings are applied on start only.
+type NetSettings struct {
+	netType     string
+	netIface    string
+	ipv6Prefix  string
+	ipv6Gateway string
+}
+
+func currentSettings() NetSettings {
+	return NetSettings{
+		netType:     *netTypeArg,
+		netIface:    *netInterface,
+		ipv6Prefix:  *ipv6Prefix,
+		ipv6Gateway: *ipv6Gateway,
+	}
+}
+
+func NewPlugin(ctx context.Context, cli dockerapi.Client, stateDir string) *NetAttachPlugin {
+	p := &NetAttachPlugin{
 		ctx:      ctx,
 		cli:      cli,
 		stateDir: stateDir + "lease/",
+		selected: make(chan struct{}),
 	}
+	plugins.AddHealthCheck("netattach-network", plugins.Readiness, p.networkHealth)
+	return p
 }
 
-func (p *NetAttachPlugin) ContainerDiscovered(cid string, cname string, image string) error {
-	return nil
+func (p *NetAttachPlugin) networkHealth() (string, error) {
+	select {
+	case <-p.selected:
+	default:
+		return "", errors.New("network selection not finished")
+	}
+	if !p.enabled {
+		return "network attach disabled", nil
+	}
+	return fmt.Sprintf("network %s (%s)", p.net.name, p.net.driver), nil
 }
 
 func (p *NetAttachPlugin) Start() error {
@@ -69,6 +132,8 @@ func (p *NetAttachPlugin) Start() error {
 		os.Exit(0)
 	}
 
+	p.settings = currentSettings()
+
 	var netType NetType
 	switch *netTypeArg {
 	case "":
@@ -78,7 +143,7 @@ func (p *NetAttachPlugin) Start() error {
 	case "ipvlan":
 		netType = Ipvlan
 	default:
-		log.Fatalf(`Invalid --net-type="%s".`, netTypeArg)
+		log.Fatalf(`Invalid --net-type="%s".`, *netTypeArg)
 	}
 
 	if netType != None && *netInterface == "" {
@@ -98,7 +163,13 @@ func (p *NetAttachPlugin) Start() error {
 			if *ipv6Prefix != "" {
 				netConfV6, err = staticNetConfV6(*ipv6Prefix, "")
 			} else {
-				netConfV6, err = dhcpNetConfV6(p.ctx, *netInterface, false)
+				var keeper *DhcpKeeper
+				keeper, err = dhcpNetConfV6(p.ctx, *netInterface, false)
+				if err == nil {
+					netConfV6 = keeper.netConf
+					p.background(keeper.renewLoop)
+					plugins.AddHealthCheck("netattach-dhcpv6", plugins.Liveness, keeper.health)
+				}
 			}
 			if err != nil {
 				log.Fatal(err)
@@ -118,7 +189,7 @@ func (p *NetAttachPlugin) Start() error {
 			if err != nil {
 				log.Fatal(err)
 			}
-			go dhcpRenewLoopV4(p.ctx)
+			p.background(func() { dhcpRenewLoopV4(p.ctx) })
 		}
 
 		netConf := mergeNetConf(netConfV4, netConfV6, netType)
@@ -128,52 +199,132 @@ func (p *NetAttachPlugin) Start() error {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if netType == Bridge {
+			if err := migratePortRules(p.ctx, p.cli, &p.net); err != nil {
+				log.Error("Error migrating ip6tables rules: ", err)
+			}
+		}
 
+		registerMetrics(netType)
 		p.enabled = true
 	}
 
+	close(p.selected)
 	return nil
 }
 
-func (p *NetAttachPlugin) ContainerCreated(cid string, cname string, image string) error {
+func (p *NetAttachPlugin) Stop(ctx context.Context) error {
+	// background loops exit when the main context is cancelled
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *NetAttachPlugin) Reload() error {
+	if currentSettings() != p.settings {
+		log.Warn("Network settings changed, restart vastai-helper to apply them")
+	}
+	return nil
+}
+
+func (p *NetAttachPlugin) background(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		plugins.Supervise(p.ctx, pluginName, f)
+	}()
+}
+
+func (p *NetAttachPlugin) ContainerCreated(ctx context.Context, event *plugins.Event) error {
 	if p.enabled &&
-		shouldAttachContainer(cname, image) {
-		return attachContainerToNet(p.ctx, p.cli, &Attachment{cid: cid, cname: cname, net: &p.net})
+		shouldAttachContainer(event) {
+		return attachContainerToNet(ctx, p.cli, p.attachment(event))
 	}
 	return nil
 }
 
-func (p *NetAttachPlugin) ContainerDestroyed(cid string, cname string, image string) error {
+func (p *NetAttachPlugin) ContainerDestroyed(ctx context.Context, event *plugins.Event) error {
 	if p.enabled &&
-		shouldAttachContainer(cname, image) {
-		return detachContainerFromNet(p.ctx, p.cli, &Attachment{cid: cid, cname: cname, net: &p.net})
+		shouldAttachContainer(event) {
+		return detachContainerFromNet(ctx, p.cli, p.attachment(event))
 	}
 	return nil
 }
 
-func (p *NetAttachPlugin) ContainerStarted(cid string, cname string, image string) error {
+func (p *NetAttachPlugin) ContainerStarted(ctx context.Context, event *plugins.Event) error {
 	if p.enabled &&
-		shouldAttachContainer(cname, image) &&
+		shouldAttachContainer(event) &&
 		p.net.driver == "bridge" {
-		return routePorts(p.ctx, p.cli, &Attachment{cid: cid, cname: cname, net: &p.net})
+		return routePorts(ctx, p.cli, p.attachment(event))
 	}
 	return nil
 }
 
-func (p *NetAttachPlugin) ContainerStopped(cid string, cname string, image string) error {
+func (p *NetAttachPlugin) ContainerStopped(ctx context.Context, event *plugins.Event) error {
 	if p.enabled &&
-		shouldAttachContainer(cname, image) &&
+		shouldAttachContainer(event) &&
 		p.net.driver == "bridge" {
-		return unroutePorts(p.ctx, p.cli, &Attachment{cid: cid, cname: cname, net: &p.net})
+		return unroutePorts(ctx, p.cli, p.attachment(event))
 	}
 	return nil
 }
 
-func (p *NetAttachPlugin) ImageRemoved(image string) error {
+func (p *NetAttachPlugin) NetworkDisconnected(ctx context.Context, event *plugins.Event) error {
+	if p.enabled &&
+		event.NetworkId == p.net.id &&
+		shouldAttachContainer(event) {
+		return reattachContainerToNet(ctx, p.cli, p.attachment(event))
+	}
 	return nil
 }
 
-func shouldAttachContainer(cname string, image string) bool {
-	// temporarily exclude vast.ai containers and promtail
-	return !strings.HasPrefix(cname, "C.") && cname != "promtail"
+func (p *NetAttachPlugin) attachment(event *plugins.Event) *Attachment {
+	return &Attachment{cid: event.ContainerId, cname: event.ContainerName, net: &p.net}
+}
+
+func (p *NetAttachPlugin) KnownContainers() (map[string]bool, error) {
+	result := make(map[string]bool)
+	if !p.enabled {
+		return result, nil
+	}
+
+	if p.net.driver == "ipvlan" {
+		// containers with DHCP leases
+		leases, err := loadAllLeases()
+		if err != nil {
+			return result, err
+		}
+		for _, lease := range leases {
+			result[hex.EncodeToString(lease.ClientId)] = false
+		}
+	}
+
+	if p.net.driver == "bridge" {
+		// containers with exposed ports
+		ipt, err := newIp6tables()
+		if err != nil {
+			return result, err
+		}
+		rules, err := listPortRules(ipt)
+		if err != nil {
+			return result, err
+		}
+		for _, r := range rules {
+			result[r.cid] = true
+		}
+	}
+
+	return result, nil
+}
+
+func shouldAttachContainer(event *plugins.Event) bool {
+	return attachFilter.Match(rules.Container{Name: event.ContainerName, Image: event.Image, Labels: event.Labels})
 }
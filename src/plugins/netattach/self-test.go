@@ -10,9 +10,17 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+
+	"vastai-helper/src/dockerapi"
 )
 
-func selfTest(ctx context.Context, cli *client.Client) error {
+func selfTest(ctx context.Context, api dockerapi.Client) error {
+	// the self-test creates and runs a container, which is beyond the fake
+	cli, ok := api.(client.ContainerAPIClient)
+	if !ok {
+		return errors.New("Self-test requires a connection to the Docker daemon")
+	}
+
 	fileInfo, _ := os.Stderr.Stat()
 	isTty := (fileInfo.Mode() & os.ModeCharDevice) != 0
 
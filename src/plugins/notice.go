@@ -0,0 +1,45 @@
+package plugins
+
+import (
+	"context"
+	"time"
+)
+
+// Notice describes something a plugin did or observed on the host, which is
+// not a docker event, e.g. a finished prune run or a changed DHCP lease.
+type Notice struct {
+	Kind          string // "prune" / "lease_ip_change"
+	Time          time.Time
+	Plugin        string // plugin which raised the notice
+	ContainerId   string
+	ContainerName string
+	Details       map[string]string
+}
+
+// NoticeHandler is implemented by plugins which want to receive notices
+// raised by other plugins. It is called from the goroutine raising the
+// notice, also after Stop, with a context which has a deadline, and should
+// only queue the notice.
+type NoticeHandler interface {
+	HandleNotice(ctx context.Context, notice *Notice) error
+}
+
+var notifier func(notice *Notice)
+
+// SetNotifier sets the function delivering notices to plugins. It must be
+// called before plugins are started.
+func SetNotifier(f func(notice *Notice)) {
+	notifier = f
+}
+
+// Notify delivers the notice to all plugins implementing NoticeHandler. The
+// time is filled in if not set.
+func Notify(notice Notice) {
+	if notifier == nil {
+		return
+	}
+	if notice.Time.IsZero() {
+		notice.Time = time.Now()
+	}
+	notifier(&notice)
+}
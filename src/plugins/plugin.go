@@ -0,0 +1,170 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// EventVersion is incremented on incompatible changes of Event.
+const EventVersion = 1
+
+// Event describes what happened to a container or an image.
+type Event struct {
+	Version       int
+	Action        string // create / start / die / destroy / delete / discover / ...
+	Time          time.Time
+	Synthetic     bool // not received from docker, but discovered or reconciled
+	ContainerId   string
+	ContainerName string
+	Image         string
+	ExitCode      int
+	Signal        int // for containers killed with a signal
+	Labels        map[string]string
+	Attributes    map[string]string // raw docker event attributes
+	HealthStatus  string            // for health_status
+	ExecCommand   string            // for exec_start
+	OldName       string            // for rename
+	NetworkId     string            // for network connect / disconnect
+	NetworkName   string
+}
+
+// Plugin hooks are called with a context which has a deadline. Calls for
+// the same container are never concurrent, but calls for different
+// containers may be. The event is shared between plugins and must not be
+// modified.
+type Plugin interface {
+	Start() error
+	Stop(ctx context.Context) error
+	ContainerDiscovered(ctx context.Context, event *Event) error
+	ContainerCreated(ctx context.Context, event *Event) error
+	ContainerDestroyed(ctx context.Context, event *Event) error
+	ContainerStarted(ctx context.Context, event *Event) error
+	ContainerStopped(ctx context.Context, event *Event) error
+	ImageRemoved(ctx context.Context, event *Event) error
+	ContainerPaused(ctx context.Context, event *Event) error
+	ContainerUnpaused(ctx context.Context, event *Event) error
+	ContainerOOM(ctx context.Context, event *Event) error
+	ContainerExec(ctx context.Context, event *Event) error
+	ContainerHealthStatus(ctx context.Context, event *Event) error
+	ContainerRenamed(ctx context.Context, event *Event) error
+	NetworkConnected(ctx context.Context, event *Event) error
+	NetworkDisconnected(ctx context.Context, event *Event) error
+}
+
+// StatefulPlugin is implemented by plugins that keep per-container state
+// which outlives a restart of vastai-helper (e.g. DHCP leases or firewall
+// rules). KnownContainers returns ids of such containers and whether the
+// plugin considers them running. Reconciliation cleans up after known
+// containers which disappeared in the meantime, and replays the creation and
+// start of the others, so hooks must tolerate containers already handled.
+type StatefulPlugin interface {
+	KnownContainers() (map[string]bool, error)
+}
+
+// Reloader is implemented by plugins which can apply changed settings
+// without a restart. Reload is called after the configuration file has been
+// reloaded on SIGHUP, never concurrently with Start or Stop.
+type Reloader interface {
+	Reload() error
+}
+
+// AdminPlugin is implemented by plugins which offer information or actions
+// on the admin socket. The handlers are served below /plugins/<name>/, keyed
+// by the rest of the path.
+type AdminPlugin interface {
+	AdminHandlers() map[string]http.HandlerFunc
+}
+
+// WriteJson writes v as the JSON response of an admin or API handler.
+func WriteJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Base implements Plugin with no-ops, to be embedded by plugins which are
+// only interested in some of the hooks.
+type Base struct{}
+
+func (Base) Start() error {
+	return nil
+}
+
+func (Base) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (Base) ContainerDiscovered(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerCreated(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerDestroyed(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerStarted(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerStopped(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ImageRemoved(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerPaused(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerUnpaused(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerOOM(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerExec(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerHealthStatus(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) ContainerRenamed(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) NetworkConnected(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (Base) NetworkDisconnected(ctx context.Context, event *Event) error {
+	return nil
+}
+
+// Sleep waits for the given duration, returning false if ctx was cancelled
+// in the meantime.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,79 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/logging"
+)
+
+// Factory creates a plugin instance. stateDir is the root state directory,
+// plugins keep their files in a subdirectory of it.
+type Factory func(ctx context.Context, cli dockerapi.Client, stateDir string) Plugin
+
+// Registration describes a plugin known to the daemon.
+type Registration struct {
+	Name        string
+	Description string
+	New         Factory
+	Flags       []string // names of the flags owned by the plugin
+	Package     string   // import path, entries logged from it belong to the plugin
+}
+
+var registry = make(map[string]*Registration)
+
+// Register makes a plugin available under the given name. It is meant to be
+// called from the init function of the plugin package.
+func Register(name string, description string, factory Factory) {
+	r := lookupOrCreate(name)
+	if r.New != nil {
+		panic(fmt.Sprintf("plugin %q registered twice", name))
+	}
+	r.Description = description
+	r.New = factory
+	r.Package = logging.CallerPackage(1)
+}
+
+// Flag defines a command line flag owned by the named plugin, so that it is
+// listed in the plugin's section of --help.
+func Flag(plugin string, name string, help string) *kingpin.FlagClause {
+	r := lookupOrCreate(plugin)
+	r.Flags = append(r.Flags, name)
+	return kingpin.Flag(name, help)
+}
+
+// flags are usually defined before Register is called
+func lookupOrCreate(name string) *Registration {
+	r, ok := registry[name]
+	if !ok {
+		r = &Registration{Name: name}
+		registry[name] = r
+	}
+	return r
+}
+
+// Lookup returns the named plugin, or nil if no such plugin is registered.
+func Lookup(name string) *Registration {
+	if r, ok := registry[name]; ok && r.New != nil {
+		return r
+	}
+	return nil
+}
+
+// Registered returns all registered plugins sorted by name.
+func Registered() []*Registration {
+	list := make([]*Registration, 0, len(registry))
+	for _, r := range registry {
+		if r.New != nil {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
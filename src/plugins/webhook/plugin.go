@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/config"
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/plugins"
+)
+
+const pluginName = "webhook"
+
+func init() {
+	plugins.Register(pluginName, "Posts signed JSON notifications about container and host events.",
+		func(ctx context.Context, cli dockerapi.Client, stateDir string) plugins.Plugin {
+			return NewPlugin(ctx, stateDir)
+		})
+}
+
+// events which can be selected with --webhook-event
+const (
+	ContainerKilled = "container_killed" // exited because of a signal
+	ContainerError  = "container_error"  // exited with a non-zero code
+	ContainerOOM    = "container_oom"
+	Prune           = "prune"           // prune run which reclaimed space
+	LeaseIpChange   = "lease_ip_change" // DHCPv4 renewal returned another address
+)
+
+var (
+	urls = config.StringList(plugins.Flag(pluginName,
+		"webhook-url",
+		"URL to post notifications to (repeatable). Nothing is posted by default.",
+	).PlaceHolder("URL"))
+	secret = plugins.Flag(pluginName,
+		"webhook-secret",
+		"Key for the HMAC-SHA256 signature sent in the X-Vastai-Helper-Signature header.",
+	).String()
+	selectedEvents = config.StringList(plugins.Flag(pluginName,
+		"webhook-event",
+		"Event to notify about (repeatable): container_killed, container_error, container_oom, prune, lease_ip_change.",
+	).Default(ContainerKilled, ContainerError, ContainerOOM, Prune, LeaseIpChange).PlaceHolder("EVENT"))
+	timeout = plugins.Flag(pluginName,
+		"webhook-timeout",
+		"Timeout of a single delivery attempt.",
+	).Default("10s").Duration()
+	attempts = plugins.Flag(pluginName,
+		"webhook-attempts",
+		"Delivery attempts, with exponential backoff, before a notification is spooled.",
+	).Default("5").Int()
+	spoolInterval = plugins.Flag(pluginName,
+		"webhook-spool-interval",
+		"Interval between attempts to deliver spooled notifications.",
+	).Default("1m").Duration()
+)
+
+// Settings are read for every notification, so that they can be reloaded.
+type Settings struct {
+	urls          []string
+	secret        string
+	events        map[string]bool
+	timeout       time.Duration
+	attempts      int
+	spoolInterval time.Duration
+}
+
+func currentSettings() Settings {
+	events := make(map[string]bool)
+	for _, event := range *selectedEvents {
+		events[event] = true
+	}
+	return Settings{
+		urls:          append([]string{}, *urls...),
+		secret:        *secret,
+		events:        events,
+		timeout:       *timeout,
+		attempts:      *attempts,
+		spoolInterval: *spoolInterval,
+	}
+}
+
+type WebhookPlugin struct {
+	plugins.Base
+	ctx      context.Context
+	host     string
+	sender   *Sender
+	settings Settings
+	mu       sync.Mutex // guards settings
+}
+
+func NewPlugin(ctx context.Context, stateDir string) *WebhookPlugin {
+	host, _ := os.Hostname()
+	p := &WebhookPlugin{
+		ctx:      ctx,
+		host:     host,
+		settings: currentSettings(),
+	}
+	p.sender = newSender(ctx, stateDir+"webhook/", p.getSettings)
+	return p
+}
+
+func (p *WebhookPlugin) getSettings() Settings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.settings
+}
+
+func (p *WebhookPlugin) Start() error {
+	if len(p.getSettings().urls) == 0 {
+		log.Info("No webhook URLs configured")
+	}
+	p.sender.start()
+	return nil
+}
+
+func (p *WebhookPlugin) Stop(ctx context.Context) error {
+	// the sender spools queued notifications when the main context is cancelled
+	select {
+	case <-p.sender.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *WebhookPlugin) Reload() error {
+	p.mu.Lock()
+	p.settings = currentSettings()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *WebhookPlugin) ContainerStopped(ctx context.Context, event *plugins.Event) error {
+	if event.Synthetic {
+		// the exit status is not known for missed events
+		return nil
+	}
+	if event.Signal != 0 {
+		p.notify(ContainerKilled, event.Time, containerOf(event), nil)
+	} else if event.ExitCode != 0 {
+		p.notify(ContainerError, event.Time, containerOf(event), nil)
+	}
+	return nil
+}
+
+func (p *WebhookPlugin) ContainerOOM(ctx context.Context, event *plugins.Event) error {
+	p.notify(ContainerOOM, event.Time, containerOf(event), nil)
+	return nil
+}
+
+func (p *WebhookPlugin) HandleNotice(ctx context.Context, notice *plugins.Notice) error {
+	var container *Container
+	if notice.ContainerId != "" || notice.ContainerName != "" {
+		container = &Container{Id: notice.ContainerId, Name: notice.ContainerName}
+	}
+	p.notify(notice.Kind, notice.Time, container, notice.Details)
+	return nil
+}
+
+func containerOf(event *plugins.Event) *Container {
+	return &Container{
+		Id:       event.ContainerId,
+		Name:     event.ContainerName,
+		Image:    event.Image,
+		ExitCode: event.ExitCode,
+		Signal:   event.Signal,
+	}
+}
+
+// notify queues the notification for every configured URL, if the event is
+// selected.
+func (p *WebhookPlugin) notify(event string, t time.Time, container *Container, details map[string]string) {
+	settings := p.getSettings()
+	if !settings.events[event] {
+		return
+	}
+	msg := Message{
+		Id:        newMessageId(),
+		Event:     event,
+		Time:      t,
+		Host:      p.host,
+		Container: container,
+		Details:   details,
+	}
+	for _, url := range settings.urls {
+		p.sender.enqueue(&Delivery{Url: url, Message: msg})
+	}
+}
@@ -0,0 +1,296 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/journal"
+	"vastai-helper/src/metrics"
+	"vastai-helper/src/plugins"
+	"vastai-helper/src/statedir"
+)
+
+var deliveries = metrics.NewCounterVec(
+	"webhook_deliveries_total",
+	"Webhook delivery outcomes: delivered, spooled or dropped.",
+	"outcome",
+)
+
+// Message is the JSON payload posted to webhook URLs.
+type Message struct {
+	Id        string            `json:"id"`
+	Event     string            `json:"event"`
+	Time      time.Time         `json:"time"`
+	Host      string            `json:"host"`
+	Container *Container        `json:"container,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+type Container struct {
+	Id       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Image    string `json:"image,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Signal   int    `json:"signal,omitempty"`
+}
+
+// Delivery is a message for a single URL, as stored in the spool.
+type Delivery struct {
+	Url     string  `json:"url"`
+	Message Message `json:"message"`
+}
+
+// newMessageId returns ids which sort in creation order.
+func newMessageId() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(random))
+}
+
+// Sender delivers notifications one at a time, retrying with backoff.
+// Notifications which cannot be delivered are spooled to files and retried
+// periodically, also after a restart.
+type Sender struct {
+	ctx      context.Context
+	client   *http.Client
+	spoolDir string
+	settings func() Settings
+	queue    chan *Delivery
+	stopped  bool       // set when the loop no longer reads the queue
+	mu       sync.Mutex // guards stopped and sends to queue
+	done     chan struct{}
+}
+
+func newSender(ctx context.Context, spoolDir string, settings func() Settings) *Sender {
+	return &Sender{
+		ctx:      ctx,
+		client:   &http.Client{},
+		spoolDir: spoolDir,
+		settings: settings,
+		queue:    make(chan *Delivery, 256),
+		done:     make(chan struct{}),
+	}
+}
+
+// enqueue queues the notification for delivery. Once the loop has stopped,
+// notifications go straight to the spool.
+func (s *Sender) enqueue(d *Delivery) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		s.spool(d)
+		return
+	}
+	select {
+	case s.queue <- d:
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		log.WithFields(d.logFields()).Warn("Webhook queue is full, spooling notification")
+		s.spool(d)
+	}
+}
+
+// start runs the loop until the context is cancelled.
+func (s *Sender) start() {
+	go func() {
+		defer close(s.done)
+		plugins.Supervise(s.ctx, pluginName, s.loop)
+	}()
+}
+
+// loop sends notifications until the context is cancelled, then spools the
+// ones still queued.
+func (s *Sender) loop() {
+	os.MkdirAll(s.spoolDir, 0700)
+
+	timer := time.NewTimer(0) // deliver leftovers of the previous run first
+	defer timer.Stop()
+	for {
+		select {
+		case d := <-s.queue:
+			s.deliver(d)
+		case <-timer.C:
+			s.deliverSpooled()
+			timer.Reset(s.settings().spoolInterval)
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			s.stopped = true
+			s.mu.Unlock()
+			for {
+				select {
+				case d := <-s.queue:
+					s.spool(d)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts the notification, retrying with exponential backoff, and
+// spools it if all attempts fail.
+func (s *Sender) deliver(d *Delivery) {
+	settings := s.settings()
+	logger := log.WithFields(d.logFields())
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := s.post(d, settings)
+		if err == nil {
+			logger.Info("Delivered webhook notification")
+			deliveries.With("delivered").Inc()
+			s.record(d, nil)
+			return
+		}
+		logger.WithFields(log.Fields{"attempt": attempt}).Warn("Webhook delivery failed: ", err)
+		if attempt >= settings.attempts || !plugins.Sleep(s.ctx, delay) {
+			s.record(d, err)
+			s.spool(d)
+			return
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
+
+func (s *Sender) post(d *Delivery, settings Settings) error {
+	body, err := json.Marshal(&d.Message)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, settings.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vastai-helper")
+	req.Header.Set("X-Vastai-Helper-Event", d.Message.Event)
+	req.Header.Set("X-Vastai-Helper-Delivery", d.Message.Id)
+	if settings.secret != "" {
+		req.Header.Set("X-Vastai-Helper-Signature", "sha256="+Sign(body, settings.secret))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", d.Url, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body, receivers compare it
+// with the X-Vastai-Helper-Signature header.
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Sender) spoolFile(d *Delivery) string {
+	h := fnv.New32a()
+	h.Write([]byte(d.Url))
+	return fmt.Sprintf("%s%s-%08x.json", s.spoolDir, d.Message.Id, h.Sum32())
+}
+
+func (s *Sender) spool(d *Delivery) {
+	logger := log.WithFields(d.logFields())
+	data, err := json.Marshal(d)
+	if err == nil {
+		err = statedir.WriteFile(s.spoolFile(d), data, 0600)
+	}
+	if err != nil {
+		logger.Error("Error spooling webhook notification: ", err)
+		deliveries.With("dropped").Inc()
+		return
+	}
+	deliveries.With("spooled").Inc()
+}
+
+// deliverSpooled makes a single attempt for each spooled notification, oldest
+// first. Notifications for URLs which are no longer configured are dropped.
+func (s *Sender) deliverSpooled() {
+	files, err := filepath.Glob(s.spoolDir + "*.json")
+	if err != nil || len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+	settings := s.settings()
+	configured := make(map[string]bool)
+	for _, url := range settings.urls {
+		configured[url] = true
+	}
+
+	for _, file := range files {
+		if s.ctx.Err() != nil {
+			return
+		}
+		logger := log.WithFields(log.Fields{"file": file})
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		var d Delivery
+		if err := json.Unmarshal(data, &d); err != nil {
+			logger.Error("Dropping invalid spooled webhook notification: ", err)
+			os.Remove(file)
+			continue
+		}
+		logger = logger.WithFields(d.logFields())
+		if !configured[d.Url] {
+			logger.Warn("Dropping spooled webhook notification for unconfigured URL")
+			deliveries.With("dropped").Inc()
+			os.Remove(file)
+			continue
+		}
+		if err := s.post(&d, settings); err != nil {
+			logger.Warn("Spooled webhook delivery failed: ", err)
+			continue
+		}
+		logger.Info("Delivered spooled webhook notification")
+		deliveries.With("delivered").Inc()
+		s.record(&d, nil)
+		os.Remove(file)
+	}
+}
+
+func (s *Sender) record(d *Delivery, err error) {
+	e := journal.Entry{
+		Details: map[string]string{"url": d.Url, "event": d.Message.Event, "id": d.Message.Id},
+	}
+	if c := d.Message.Container; c != nil {
+		e.Cid = c.Id
+		e.Cname = c.Name
+		e.Image = c.Image
+	}
+	journal.Action(pluginName, "deliver webhook", e, err)
+}
+
+func (d *Delivery) logFields() log.Fields {
+	return log.Fields{"url": d.Url, "event": d.Message.Event, "id": d.Message.Id}
+}
@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a local stand-in for a webhook endpoint, answering with the
+// queued status codes and then with fallback, 200 if not set.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	fallback int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	status := http.StatusOK
+	if r.fallback != 0 {
+		status = r.fallback
+	}
+	if len(r.statuses) > 0 {
+		status = r.statuses[0]
+		r.statuses = r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func (r *receiver) setFallback(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = status
+}
+
+func testSettings(url string, attempts int) func() Settings {
+	return func() Settings {
+		return Settings{
+			urls:          []string{url},
+			secret:        "secret",
+			events:        map[string]bool{Prune: true},
+			timeout:       5 * time.Second,
+			attempts:      attempts,
+			spoolInterval: time.Hour,
+		}
+	}
+}
+
+func testDelivery(url string) *Delivery {
+	return &Delivery{
+		Url: url,
+		Message: Message{
+			Id:    newMessageId(),
+			Event: Prune,
+			Time:  time.Now(),
+			Host:  "host",
+		},
+	}
+}
+
+// startSender runs a sender until the returned function is called.
+func startSender(t *testing.T, spoolDir string, settings func() Settings) (*Sender, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSender(ctx, spoolDir, settings)
+	s.start()
+	return s, func() {
+		cancel()
+		<-s.done
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func spooled(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(dir + "*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDeliverySignature(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	s, stop := startSender(t, t.TempDir()+"/", testSettings(server.URL, 1))
+	defer stop()
+
+	d := testDelivery(server.URL)
+	s.enqueue(d)
+	waitFor(t, "delivery", func() bool { return r.count() == 1 })
+
+	r.mu.Lock()
+	req, body := r.requests[0], r.bodies[0]
+	r.mu.Unlock()
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get("X-Vastai-Helper-Signature") != want {
+		t.Errorf("signature %q, want %q", req.Header.Get("X-Vastai-Helper-Signature"), want)
+	}
+	if req.Header.Get("X-Vastai-Helper-Delivery") != d.Message.Id {
+		t.Errorf("delivery id %q, want %q", req.Header.Get("X-Vastai-Helper-Delivery"), d.Message.Id)
+	}
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil || msg.Event != Prune {
+		t.Errorf("unexpected body %s (%v)", body, err)
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	r := &receiver{statuses: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	dir := t.TempDir() + "/"
+	s, stop := startSender(t, dir, testSettings(server.URL, 3))
+	defer stop()
+
+	started := time.Now()
+	s.enqueue(testDelivery(server.URL))
+	waitFor(t, "retry", func() bool { return r.count() == 2 })
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("retried after %v, expected a backoff of 1s", elapsed)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if files := spooled(t, dir); len(files) != 0 {
+		t.Errorf("delivered notification was spooled: %v", files)
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	// failing until the replay, also when the spool is retried meanwhile
+	r := &receiver{fallback: http.StatusServiceUnavailable}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	dir := t.TempDir() + "/"
+
+	s, stop := startSender(t, dir, testSettings(server.URL, 1))
+	s.enqueue(testDelivery(server.URL))
+	waitFor(t, "spooling", func() bool { return len(spooled(t, dir)) == 1 })
+	stop()
+
+	// queued after the loop stopped
+	s.enqueue(testDelivery(server.URL))
+	if files := spooled(t, dir); len(files) != 2 {
+		t.Fatalf("%d notifications spooled, want 2", len(files))
+	}
+
+	// a restarted sender delivers the spool first
+	r.setFallback(http.StatusOK)
+	failed := r.count()
+	_, stop = startSender(t, dir, testSettings(server.URL, 1))
+	defer stop()
+	waitFor(t, "spool replay", func() bool { return len(spooled(t, dir)) == 0 })
+	if n := r.count() - failed; n != 2 {
+		t.Errorf("%d requests for the replay, want 2", n)
+	}
+}
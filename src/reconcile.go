@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/docker/docker/api/types"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/plugins"
+)
+
+var (
+	reconcileInterval = kingpin.Flag(
+		"reconcile-interval",
+		"Interval between container state reconciliation passes.",
+	).Default("10m").Duration()
+)
+
+type containerState struct {
+	cname   string
+	image   string
+	labels  map[string]string
+	running bool
+}
+
+// pluginStates records, per plugin, what the plugin has successfully been
+// told about each container. Reconciliation compares it with the containers
+// actually present and synthesizes the calls which were missed.
+var (
+	pluginStates   = make(map[plugins.Plugin]map[string]containerState)
+	pluginStatesMu sync.Mutex
+)
+
+func setPluginState(p plugins.Plugin, cid string, state *containerState) {
+	pluginStatesMu.Lock()
+	defer pluginStatesMu.Unlock()
+	states, ok := pluginStates[p]
+	if !ok {
+		states = make(map[string]containerState)
+		pluginStates[p] = states
+	}
+	if state == nil {
+		delete(states, cid)
+	} else {
+		states[cid] = *state
+	}
+}
+
+func getPluginStates(p plugins.Plugin) map[string]containerState {
+	pluginStatesMu.Lock()
+	defer pluginStatesMu.Unlock()
+	result := make(map[string]containerState, len(pluginStates[p]))
+	for cid, state := range pluginStates[p] {
+		result[cid] = state
+	}
+	return result
+}
+
+// findContainerState returns what any of the plugins knows about a container.
+func findContainerState(cid string) (containerState, bool) {
+	pluginStatesMu.Lock()
+	defer pluginStatesMu.Unlock()
+	for _, states := range pluginStates {
+		if state, ok := states[cid]; ok && state.image != "" {
+			return state, true
+		}
+	}
+	return containerState{}, false
+}
+
+func renameContainerState(cid string, cname string) {
+	pluginStatesMu.Lock()
+	defer pluginStatesMu.Unlock()
+	for _, states := range pluginStates {
+		if state, ok := states[cid]; ok {
+			state.cname = cname
+			states[cid] = state
+		}
+	}
+}
+
+// isRunning tells whether a container in the given state was started and
+// has not stopped yet.
+func isRunning(status string) bool {
+	return status == "running" || status == "paused"
+}
+
+func loadKnownContainers() {
+	for _, p := range activePlugins {
+		sp, ok := p.(plugins.StatefulPlugin)
+		if !ok {
+			continue
+		}
+		var known map[string]bool
+		err := protect(p, func() (err error) {
+			known, err = sp.KnownContainers()
+			return err
+		})
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		believed := getPluginStates(p)
+		for cid, running := range known {
+			// stale state of stopped containers shows up as running
+			state, ok := believed[cid]
+			if !ok || (running && !state.running) {
+				state.running = running
+				setPluginState(p, cid, &state)
+			}
+		}
+	}
+}
+
+// reconcileContainers must be called from the event loop (or before it is
+// started), so that no new events are dispatched while it is running.
+func reconcileContainers(ctx context.Context, cli dockerapi.Client) error {
+	// let plugins catch up with the events already dispatched
+	dispatcher.wait()
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+	})
+	if err != nil {
+		return err
+	}
+	observed := make(map[string]containerState)
+	for _, container := range containers {
+		cname := strings.TrimLeft(container.Names[0], "/")
+		if shouldWatchContainer(cname, container.Image, container.Labels) {
+			observed[container.ID] = containerState{
+				cname:   cname,
+				image:   container.Image,
+				labels:  container.Labels,
+				running: isRunning(container.State),
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{"count": len(observed)}).Info("Reconciling container state")
+	for _, p := range activePlugins {
+		reconcilePlugin(p, observed)
+	}
+	return nil
+}
+
+func reconcilePlugin(p plugins.Plugin, observed map[string]containerState) {
+	believed := getPluginStates(p)
+
+	for cid, obs := range observed {
+		bel, known := believed[cid]
+		if known && bel.running == obs.running {
+			continue
+		}
+		cid, obs := cid, obs
+		dispatcher.dispatchTo(p, cid, func(ctx context.Context, p plugins.Plugin) error {
+			if !known {
+				bel = obs
+				bel.running = false
+				if err := syncPlugin(ctx, p, cid, &bel, &bel, "create", plugins.Plugin.ContainerCreated); err != nil {
+					return err
+				}
+			}
+			if obs.running && !bel.running {
+				return syncPlugin(ctx, p, cid, &obs, &obs, "start", plugins.Plugin.ContainerStarted)
+			} else if !obs.running && bel.running {
+				return syncPlugin(ctx, p, cid, &obs, &obs, "die", plugins.Plugin.ContainerStopped)
+			}
+			return nil
+		})
+	}
+
+	for cid, bel := range believed {
+		if _, ok := observed[cid]; ok {
+			continue
+		}
+		cid, bel := cid, bel
+		dispatcher.dispatchTo(p, cid, func(ctx context.Context, p plugins.Plugin) error {
+			if bel.running {
+				stopped := bel
+				stopped.running = false
+				if err := syncPlugin(ctx, p, cid, &bel, &stopped, "die", plugins.Plugin.ContainerStopped); err != nil {
+					return err
+				}
+			}
+			return syncPlugin(ctx, p, cid, &bel, nil, "destroy", plugins.Plugin.ContainerDestroyed)
+		})
+	}
+}
+
+// syncPlugin delivers a synthesized event to a single plugin, and records
+// newState (nil for destroyed containers) if the plugin handled it.
+func syncPlugin(ctx context.Context, p plugins.Plugin, cid string, state *containerState, newState *containerState, action string, f hook) error {
+	logger := log.WithFields(log.Fields{
+		"event":  action,
+		"cid":    shortId(cid),
+		"cname":  state.cname,
+		"plugin": pluginName(p),
+	})
+	logger.Info("Synthesizing missed container event")
+	if err := f(p, ctx, newSyntheticEvent(action, cid, state)); err != nil {
+		pluginFailed(p, err, logger)
+		return err
+	}
+	setPluginState(p, cid, newState)
+	return nil
+}
+
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[0:12]
+	}
+	return id
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"vastai-helper/src/dockerapi"
+	"vastai-helper/src/plugins"
+)
+
+// recordingPlugin records the container hooks called.
+type recordingPlugin struct {
+	plugins.Base
+	mu    sync.Mutex
+	calls []string
+}
+
+func (p *recordingPlugin) record(action string, event *plugins.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, action+" "+event.ContainerName)
+	return nil
+}
+
+func (p *recordingPlugin) ContainerCreated(ctx context.Context, event *plugins.Event) error {
+	return p.record("create", event)
+}
+
+func (p *recordingPlugin) ContainerStarted(ctx context.Context, event *plugins.Event) error {
+	return p.record("start", event)
+}
+
+func (p *recordingPlugin) ContainerStopped(ctx context.Context, event *plugins.Event) error {
+	return p.record("die", event)
+}
+
+func (p *recordingPlugin) ContainerDestroyed(ctx context.Context, event *plugins.Event) error {
+	return p.record("destroy", event)
+}
+
+func (p *recordingPlugin) sortedCalls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	calls := append([]string{}, p.calls...)
+	sort.Strings(calls)
+	return calls
+}
+
+// statefulPlugin knows the containers in known across a restart.
+type statefulPlugin struct {
+	recordingPlugin
+	known map[string]bool
+}
+
+func (p *statefulPlugin) KnownContainers() (map[string]bool, error) {
+	return p.known, nil
+}
+
+func addRunningContainer(cli *dockerapi.Fake, id string, name string) {
+	ct := dockerapi.FakeContainer(id, name, "pytorch", nil)
+	ct.State.Status = "running"
+	ct.State.Running = true
+	cli.AddContainer(ct)
+}
+
+func TestReconcileAfterDiscovery(t *testing.T) {
+	handled, missed, gone := fmt.Sprintf("%064x", 1), fmt.Sprintf("%064x", 2), fmt.Sprintf("%064x", 3)
+	cli := dockerapi.NewFake()
+	addRunningContainer(cli, handled, "C.1")
+	addRunningContainer(cli, missed, "C.2") // created while the helper was down
+
+	stateless := &recordingPlugin{}
+	stateful := &statefulPlugin{known: map[string]bool{handled: true, gone: false}}
+	defer func(list []plugins.Plugin, d *Dispatcher) {
+		activePlugins, dispatcher = list, d
+	}(activePlugins, dispatcher)
+	activePlugins = []plugins.Plugin{stateless, stateful}
+	dispatcher = newDispatcher(context.Background(), activePlugins, 1, 16, time.Minute)
+
+	ctx := context.Background()
+	if err := discoverContainers(ctx, cli); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.wait()
+	loadKnownContainers()
+	if err := reconcileContainers(ctx, cli); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.wait()
+
+	if calls := stateless.sortedCalls(); len(calls) != 0 {
+		t.Errorf("discovered containers replayed to a stateless plugin: %v", calls)
+	}
+	want := []string{"create C.2", "destroy ", "start C.2"}
+	if calls := stateful.sortedCalls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("stateful plugin got %v, want %v", calls, want)
+	}
+}
@@ -0,0 +1,77 @@
+package rules
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/config"
+)
+
+// Filter is a Set configured by a pair of include/exclude flags, which is
+// rebuilt by Load when the configuration changes.
+type Filter struct {
+	includeFlag *kingpin.FlagClause
+	excludeFlag *kingpin.FlagClause
+	include     *[]string
+	exclude     *[]string
+	builtin     []string // exclude rules applied in addition to the flag
+	mu          sync.RWMutex
+	set         *Set
+}
+
+var filters []*Filter
+
+// NewFilter turns the flags into repeatable rule lists. Filters must be
+// created before the command line is parsed.
+func NewFilter(include *kingpin.FlagClause, exclude *kingpin.FlagClause) *Filter {
+	f := &Filter{
+		includeFlag: include,
+		excludeFlag: exclude,
+		include:     config.StringList(include.PlaceHolder("RULE")),
+		exclude:     config.StringList(exclude.PlaceHolder("RULE")),
+		set:         &Set{},
+	}
+	filters = append(filters, f)
+	return f
+}
+
+// DefaultInclude sets the include rules used when none are configured.
+func (f *Filter) DefaultInclude(rules ...string) *Filter {
+	f.includeFlag.Default(rules...)
+	return f
+}
+
+// AlwaysExclude sets exclude rules which apply whatever is configured, the
+// rules of the exclude flag are added to them.
+func (f *Filter) AlwaysExclude(rules ...string) *Filter {
+	f.builtin = rules
+	return f
+}
+
+func (f *Filter) Match(c Container) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.set.Match(&c)
+}
+
+// Load parses the rules of all filters from the current flag values. Nothing
+// is changed if any rule is invalid.
+func Load() error {
+	sets := make([]*Set, len(filters))
+	for i, f := range filters {
+		exclude := append(append([]string{}, f.builtin...), *f.exclude...)
+		set, err := NewSet(*f.include, exclude)
+		if err != nil {
+			return fmt.Errorf("--%s/--%s: %v", f.includeFlag.Model().Name, f.excludeFlag.Model().Name, err)
+		}
+		sets[i] = set
+	}
+	for i, f := range filters {
+		f.mu.Lock()
+		f.set = sets[i]
+		f.mu.Unlock()
+	}
+	return nil
+}
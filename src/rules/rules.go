@@ -0,0 +1,181 @@
+// Package rules selects the containers a plugin acts on.
+//
+// A rule is a comma separated list of terms, all of which must match:
+//
+//	name=GLOB           container name
+//	name~REGEX
+//	image=GLOB          image as given when the container was created
+//	image~REGEX
+//	label=KEY           label is present
+//	label=KEY=GLOB      label value
+//	label~KEY=REGEX
+//
+// A term prefixed with "!" is negated. Globs support * and ?, regular
+// expressions are unanchored and cannot contain commas.
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Container is what rules are matched against.
+type Container struct {
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+type Rule struct {
+	text  string
+	terms []term
+}
+
+type term struct {
+	negate bool
+	field  string // "name", "image" or "label"
+	label  string
+	re     *regexp.Regexp // nil for label presence
+}
+
+func Parse(text string) (*Rule, error) {
+	rule := &Rule{text: text}
+	for _, s := range strings.Split(text, ",") {
+		t, err := parseTerm(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule %q: %v", text, err)
+		}
+		rule.terms = append(rule.terms, t)
+	}
+	return rule, nil
+}
+
+func parseTerm(s string) (term, error) {
+	t := term{}
+	if strings.HasPrefix(s, "!") {
+		t.negate = true
+		s = s[1:]
+	}
+	i := strings.IndexAny(s, "=~")
+	if i < 0 {
+		return t, fmt.Errorf("expected name, image or label condition in %q", s)
+	}
+	t.field = s[:i]
+	isRegex := s[i] == '~'
+	pattern := s[i+1:]
+
+	switch t.field {
+	case "name", "image":
+	case "label":
+		j := strings.Index(pattern, "=")
+		if j < 0 {
+			if isRegex {
+				return t, fmt.Errorf("expected KEY=REGEX in %q", s)
+			}
+			t.label = pattern
+			return t, validLabel(t.label)
+		}
+		t.label = pattern[:j]
+		pattern = pattern[j+1:]
+		if err := validLabel(t.label); err != nil {
+			return t, err
+		}
+	default:
+		return t, fmt.Errorf("unknown field %q", t.field)
+	}
+
+	var err error
+	if isRegex {
+		t.re, err = regexp.Compile(pattern)
+	} else {
+		t.re, err = compileGlob(pattern)
+	}
+	return t, err
+}
+
+func validLabel(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty label key")
+	}
+	return nil
+}
+
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	re := regexp.QuoteMeta(glob)
+	re = strings.ReplaceAll(re, `\*`, `.*`)
+	re = strings.ReplaceAll(re, `\?`, `.`)
+	return regexp.Compile("^" + re + "$")
+}
+
+func (r *Rule) Match(c *Container) bool {
+	for _, t := range r.terms {
+		if t.match(c) == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) String() string {
+	return r.text
+}
+
+func (t *term) match(c *Container) bool {
+	switch t.field {
+	case "name":
+		return t.re.MatchString(strings.TrimPrefix(c.Name, "/"))
+	case "image":
+		return t.re.MatchString(c.Image)
+	default:
+		value, ok := c.Labels[t.label]
+		return ok && (t.re == nil || t.re.MatchString(value))
+	}
+}
+
+// Set matches containers which match any of the include rules (or all
+// containers if there are none) and none of the exclude rules.
+type Set struct {
+	include []*Rule
+	exclude []*Rule
+}
+
+func NewSet(include []string, exclude []string) (*Set, error) {
+	s := &Set{}
+	var err error
+	if s.include, err = parseAll(include); err != nil {
+		return nil, err
+	}
+	if s.exclude, err = parseAll(exclude); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseAll(texts []string) ([]*Rule, error) {
+	result := []*Rule{}
+	for _, text := range texts {
+		rule, err := Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func (s *Set) Match(c *Container) bool {
+	if len(s.include) > 0 && !matchAny(s.include, c) {
+		return false
+	}
+	return !matchAny(s.exclude, c)
+}
+
+func matchAny(list []*Rule, c *Container) bool {
+	for _, rule := range list {
+		if rule.Match(c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// Package sdnotify implements the systemd service notification protocol
+// (sd_notify), used with Type=notify units for readiness, status and
+// watchdog messages. Outside of systemd all functions are no-ops.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends the state, e.g. "READY=1", to the socket given by systemd in
+// $NOTIFY_SOCKET. It does nothing if the variable is not set.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells systemd that startup is finished.
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// Stopping tells systemd that shutdown has begun.
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// Status sets the free-form status shown by systemctl status.
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+// Watchdog resets the watchdog timer of the service.
+func Watchdog() error {
+	return Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout configured with WatchdogSec,
+// or 0 if the watchdog is not enabled for this process. Pings should be sent
+// at about half this interval.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"vastai-helper/src/plugins"
+)
+
+// daemonSettings are the flags read outside the event loop, by plugin
+// workers, notices and health checks. Loading the configuration file rewrites
+// the flags, so they are copied by loadSettings once it is loaded.
+type daemonSettings struct {
+	pluginMaxFailures int
+	pluginDisableTime time.Duration
+	pluginTimeout     time.Duration
+	healthMaxEventAge time.Duration
+}
+
+var (
+	loadedSettings   daemonSettings
+	loadedSettingsMu sync.Mutex
+)
+
+// loadSettings must be called from the event loop (or before it is started)
+// after the flags changed.
+func loadSettings() {
+	s := daemonSettings{
+		pluginMaxFailures: *pluginMaxFailures,
+		pluginDisableTime: *pluginDisableTime,
+		pluginTimeout:     *pluginTimeout,
+		healthMaxEventAge: *healthMaxEventAge,
+	}
+	loadedSettingsMu.Lock()
+	loadedSettings = s
+	loadedSettingsMu.Unlock()
+	plugins.LoadSettings()
+}
+
+func getSettings() daemonSettings {
+	loadedSettingsMu.Lock()
+	defer loadedSettingsMu.Unlock()
+	return loadedSettings
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"vastai-helper/src/config"
+	"vastai-helper/src/plugins"
+)
+
+// TestReloadWhileReading is meant to be run with -race.
+func TestReloadWhileReading(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	c := config.New(kingpin.CommandLine, path)
+	load := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Load(true); err != nil {
+			t.Fatal(err)
+		}
+		loadSettings()
+	}
+	defer load("")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := &breaker{name: "test"}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			b.record(errors.New("failed"))
+			eventStreamHealth()
+			plugins.DryRun()
+		}
+	}()
+	for i := 1; i <= 100; i++ {
+		load(fmt.Sprintf("dry-run: true\nplugin-max-failures: %d\nhealth-max-event-age: %ds\n", 1000+i, i))
+	}
+	close(done)
+	wg.Wait()
+
+	if s := getSettings(); !plugins.DryRun() || s.pluginMaxFailures != 1100 || s.healthMaxEventAge.Seconds() != 100 {
+		t.Errorf("settings not loaded: dry run %v, %+v", plugins.DryRun(), s)
+	}
+}
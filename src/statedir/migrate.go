@@ -0,0 +1,107 @@
+package statedir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version is the layout version written by this build.
+const Version = 1
+
+// migration upgrades the state directory from version to version+1.
+type migration struct {
+	version     int
+	description string
+	run         func(dir string) error
+}
+
+// migrations are run in order, each one exactly once. Add a step and bump
+// Version when the layout changes.
+var migrations = []migration{
+	// the layout is unchanged, version 1 only adds the version and lock files
+	{0, "add version file", func(dir string) error { return nil }},
+}
+
+func versionFile(dir string) string {
+	return filepath.Join(dir, "version")
+}
+
+// readVersion returns 0 for directories written before the version file was
+// introduced, and Version for new ones.
+func readVersion(dir string) (int, error) {
+	data, err := ioutil.ReadFile(versionFile(dir))
+	if os.IsNotExist(err) {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			if entry.Name() != "lock" {
+				return 0, nil
+			}
+		}
+		return Version, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid state version in %s: %v", versionFile(dir), err)
+	}
+	return version, nil
+}
+
+// Migrate upgrades the state directory to Version, and removes temporary
+// files left by interrupted writes. The lock must be held.
+func Migrate(dir string) error {
+	version, err := readVersion(dir)
+	if err != nil {
+		return err
+	}
+	if version > Version {
+		return fmt.Errorf("State directory %s has version %d, which is newer than this build supports (%d)",
+			dir, version, Version)
+	}
+	for _, m := range migrations {
+		if m.version < version {
+			continue
+		}
+		logger := log.WithFields(log.Fields{"dir": dir, "from": m.version, "to": m.version + 1})
+		logger.Info("Migrating state directory: ", m.description)
+		if err := m.run(dir); err != nil {
+			return fmt.Errorf("Migrating state directory to version %d: %v", m.version+1, err)
+		}
+		// record every step, so that an interrupted migration is resumed
+		if err := writeVersion(dir, m.version+1); err != nil {
+			return err
+		}
+	}
+	if err := writeVersion(dir, Version); err != nil {
+		return err
+	}
+	return removeTempFiles(dir)
+}
+
+func writeVersion(dir string, version int) error {
+	return WriteFile(versionFile(dir), []byte(strconv.Itoa(version)+"\n"), 0600)
+}
+
+func removeTempFiles(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".tmp") {
+			log.WithFields(log.Fields{"file": path}).Info("Removing temporary file")
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
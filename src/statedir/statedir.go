@@ -0,0 +1,75 @@
+// Package statedir manages the state directory: the exclusive lock which
+// keeps two instances from using the same state, the layout version with its
+// migrations, and atomic file writes.
+package statedir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Lock is held for the lifetime of the process, it is released by the
+// kernel when the process exits.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire creates the state directory if needed and locks it exclusively.
+// It fails immediately if another process holds the lock.
+func Acquire(dir string) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid, _ := ioutil.ReadAll(file)
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("State directory %s is in use by another instance (pid %s)",
+				dir, strings.TrimSpace(string(pid)))
+		}
+		return nil, err
+	}
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return &Lock{file}, nil
+}
+
+func (l *Lock) Release() error {
+	return l.file.Close()
+}
+
+// WriteFile writes data to a temporary file in the same directory and renames
+// it over path, so that readers and a crash never see a partial file.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
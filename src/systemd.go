@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"vastai-helper/src/sdnotify"
+)
+
+// watchdogProbes are answered by the docker event loop whenever it is idle,
+// so that the systemd watchdog is only fed while the loop keeps responding.
+var watchdogProbes = make(chan struct{})
+
+func notifySystemd(err error) {
+	if err != nil {
+		log.Warn("Error notifying systemd: ", err)
+	}
+}
+
+func setStatus(status string) {
+	notifySystemd(sdnotify.Status(status))
+}
+
+// runWatchdog probes the event loop at half the watchdog interval and pings
+// systemd when it answers. A loop which is stuck, e.g. on a plugin whose
+// queue is full, gets the service restarted.
+func runWatchdog(ctx context.Context) {
+	interval := sdnotify.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.WithFields(log.Fields{"interval": interval}).Info("Starting systemd watchdog")
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case watchdogProbes <- struct{}{}:
+				notifySystemd(sdnotify.Watchdog())
+			case <-time.After(interval / 2):
+				log.Warn("Docker event loop is not responding")
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// idle sleeps while answering watchdog probes. It returns false if the
+// context was cancelled.
+func idle(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-watchdogProbes:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}